@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// responseCache is a gocmt.Cache that stores model responses on disk, so
+// that unchanged code doesn't trigger another API call across runs.
+type responseCache struct {
+	dir string
+}
+
+// cachedResponse is the on-disk format of a cached response.
+type cachedResponse struct {
+	Content string `json:"content"`
+}
+
+// newResponseCache returns a cache in the user's cache directory, e.g.
+// ~/.cache/gocmt on Linux.
+func newResponseCache() (*responseCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate cache directory: %v", err)
+	}
+	return &responseCache{dir: filepath.Join(dir, "gocmt")}, nil
+}
+
+// path returns the file a response with the given key is stored in.
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Get returns the cached response content for key, if any.
+func (c *responseCache) Get(key string) (string, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return "", false
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", false
+	}
+	return resp.Content, true
+}
+
+// Put stores the response content for key.
+func (c *responseCache) Put(key, content string) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cachedResponse{Content: content})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(key), data, 0644)
+}
+
+// clear removes all cached responses.
+func (c *responseCache) clear() error {
+	return os.RemoveAll(c.dir)
+}
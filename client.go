@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elliotxx/gocmt/pkg/gocmt"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// The supported API providers: Moonshot, which the client defaults to, and
+// a local OpenAI-compatible server such as Ollama or LM Studio, which needs
+// no API key.
+const (
+	providerMoonshot = "moonshot"
+	providerLocal    = "local"
+)
+
+// clientConfig holds the settings of the API client that don't come from
+// the environment.
+type clientConfig struct {
+	// provider is providerMoonshot or providerLocal.
+	provider string
+	// baseURL overrides MOONSHOT_BASE_URL.
+	baseURL string
+	// proxy is the URL of the proxy requests are sent through. When empty,
+	// the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables apply.
+	proxy string
+	// timeout bounds each HTTP request; zero means no timeout.
+	timeout time.Duration
+	// header holds extra headers sent with each request, such as
+	// OpenAI-Organization.
+	header http.Header
+	// idleConns is the number of idle connections kept for reuse, usually
+	// the number of concurrent files, so that connections aren't closed
+	// and dialed again between requests.
+	idleConns int
+	// maxConnsPerHost limits the connections to the API host; zero means
+	// no limit.
+	maxConnsPerHost int
+}
+
+// parseHeaders merges the headers of the headers config field with the
+// "Name=Value" or "Name: Value" values of -header, which take precedence.
+func parseHeaders(fromConfig map[string]string, flags []string) (http.Header, error) {
+	header := make(http.Header)
+	for name, value := range fromConfig {
+		header.Set(name, value)
+	}
+	for _, h := range flags {
+		i := strings.IndexAny(h, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q, must be Name=Value", h)
+		}
+		header.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return header, nil
+}
+
+// headerTransport adds header to every request sent through base.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newHTTPClient returns the HTTP client used to reach the API, going
+// through the configured proxy and adding the configured headers.
+func newHTTPClient(ccfg clientConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if ccfg.proxy != "" {
+		proxyURL, err := url.Parse(ccfg.proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", ccfg.proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	// The default keeps only two idle connections per host, which makes
+	// concurrent requests dial new ones all the time.
+	idle := ccfg.idleConns
+	if ccfg.maxConnsPerHost > 0 && idle > ccfg.maxConnsPerHost {
+		idle = ccfg.maxConnsPerHost
+	}
+	if idle > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = idle
+	}
+	transport.MaxConnsPerHost = ccfg.maxConnsPerHost
+	var rt http.RoundTripper = transport
+	if len(ccfg.header) > 0 {
+		rt = &headerTransport{base: transport, header: ccfg.header}
+	}
+	return &http.Client{Transport: rt, Timeout: ccfg.timeout}, nil
+}
+
+// newClientFromEnv creates a MoonShot API client from the MOONSHOT_API_KEY and
+// MOONSHOT_BASE_URL environment variables. A non-empty ccfg.baseURL takes
+// precedence over MOONSHOT_BASE_URL. A local provider needs a base URL but
+// no API key.
+func newClientFromEnv(ccfg clientConfig) (*openai.Client, error) {
+	local := ccfg.provider == providerLocal
+	token := os.Getenv("MOONSHOT_API_KEY")
+	if token == "" && !local {
+		return nil, fmt.Errorf("the environment variable MOONSHOT_API_KEY is not set")
+	}
+	logger.addSecret(token)
+	baseURL := ccfg.baseURL
+	if baseURL == "" {
+		baseURL = os.Getenv("MOONSHOT_BASE_URL")
+	}
+	if baseURL == "" && local {
+		return nil, fmt.Errorf("-provider local requires -base-url, e.g. http://localhost:11434/v1")
+	}
+	httpClient, err := newHTTPClient(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	return gocmt.NewMoonShotClientWithHTTPClient(baseURL, token, httpClient), nil
+}
+
+// preflightTimeout bounds the preflight request when no -timeout is set.
+const preflightTimeout = 30 * time.Second
+
+// preflight validates the credentials and the base URL with a cheap request
+// listing the models, so that a bad key fails fast with a clear message.
+func preflight(ctx context.Context, client *openai.Client, ccfg clientConfig) error {
+	timeout := ccfg.timeout
+	if timeout <= 0 {
+		timeout = preflightTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Debugf("Checking the API credentials")
+	_, err := client.ListModels(ctx)
+	if err == nil {
+		return nil
+	}
+	logger.Debugf("Preflight error: %v", err)
+
+	var status int
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	if errors.As(err, &apiErr) {
+		status = apiErr.HTTPStatusCode
+	} else if errors.As(err, &reqErr) {
+		status = reqErr.HTTPStatusCode
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the API rejected MOONSHOT_API_KEY, check that it is valid and not expired: %v", err)
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// Not every compatible API lists its models, which says nothing
+		// about the credentials.
+		return nil
+	}
+	if ccfg.provider == providerLocal {
+		return fmt.Errorf("failed to reach the local API, check -base-url and that the server is running: %v", err)
+	}
+	return fmt.Errorf("failed to reach the API, check MOONSHOT_BASE_URL and your network: %v", err)
+}
+
+// newGenerator creates the comment generator for opts with a client from
+// the environment, see newClientFromEnv.
+func newGenerator(opts gocmt.Options, ccfg clientConfig) (*gocmt.CommentGenerator, error) {
+	client, err := newClientFromEnv(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	opts.Client = client
+	return gocmt.NewCommentGenerator(opts)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// ANSI escape sequences used to color the console output.
+const (
+	colorReset = "\x1b[0m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorDim   = "\x1b[2m"
+)
+
+// markerColors maps the markers console messages start with to their color.
+var markerColors = []struct {
+	marker string
+	color  string
+}{
+	{"✔", colorGreen},
+	{"×", colorRed},
+	{"»", colorDim},
+	{"Progress:", colorDim},
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// noColorEnv reports whether the NO_COLOR environment variable asks for
+// output without colors, see https://no-color.org.
+func noColorEnv() bool {
+	return os.Getenv("NO_COLOR") != ""
+}
+
+// colorize colors msg by the marker it starts with, keeping the marker so
+// that copied output stays readable. Leading carriage returns and newlines
+// and trailing newlines are left outside the escape sequences.
+func colorize(msg string) string {
+	start := len(msg) - len(strings.TrimLeft(msg, "\r\n"))
+	end := len(strings.TrimRight(msg, "\n"))
+	if start >= end {
+		return msg
+	}
+	text := msg[start:end]
+	for _, mc := range markerColors {
+		if strings.HasPrefix(text, mc.marker) {
+			return msg[:start] + mc.color + text + colorReset + msg[end:]
+		}
+	}
+	return msg
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is loaded from the current directory when -config is not
+// given.
+const defaultConfigFile = ".gocmt.yaml"
+
+// fileConfig mirrors the command line flags that can be given defaults in a
+// config file. The flag tag names the flag a field sets; fields left unset in
+// the file keep the built-in defaults.
+type fileConfig struct {
+	Concurrency *int     `yaml:"concurrency" flag:"n"`
+	Provider    *string  `yaml:"provider" flag:"provider"`
+	Model       *string  `yaml:"model" flag:"model"`
+	Temperature *float64 `yaml:"temperature" flag:"temperature"`
+	Lang        *string  `yaml:"lang" flag:"lang"`
+	Tags        *string  `yaml:"tags" flag:"tags"`
+	Scope       *string  `yaml:"scope" flag:"scope"`
+	Match       *string  `yaml:"match" flag:"match"`
+	Timeout     *string  `yaml:"timeout" flag:"timeout"`
+	RPM         *int     `yaml:"rpm" flag:"rpm"`
+	Proxy       *string  `yaml:"proxy" flag:"proxy"`
+	DryRun      *bool    `yaml:"dry_run" flag:"dry-run"`
+	MaxComments *int     `yaml:"max_comments" flag:"max-comments"`
+	Overwrite   *bool    `yaml:"overwrite" flag:"overwrite"`
+	Fields      *bool    `yaml:"fields" flag:"fields"`
+	KeepImports *bool    `yaml:"keep_imports" flag:"keep-imports"`
+	KeepBodies  *bool    `yaml:"keep_bodies" flag:"keep-bodies"`
+	Explain     *bool    `yaml:"explain" flag:"explain"`
+	Formatter   *string  `yaml:"formatter" flag:"formatter"`
+	NoReformat  *bool    `yaml:"no_reformat" flag:"no-reformat"`
+	Wrap        *int     `yaml:"wrap" flag:"wrap"`
+	Style       *string  `yaml:"style" flag:"style"`
+	GodocStyle  *bool    `yaml:"godoc_style" flag:"godoc-style"`
+	Backup      *bool    `yaml:"backup" flag:"backup"`
+	Patch       *string  `yaml:"patch" flag:"patch"`
+	OutputDir   *string  `yaml:"output_dir" flag:"output-dir"`
+	State       *string  `yaml:"state" flag:"state"`
+	FailFast    *bool    `yaml:"fail_fast" flag:"fail-fast"`
+	Log         *string  `yaml:"log" flag:"log"`
+	PromptFile  *string  `yaml:"prompt_file" flag:"prompt-file"`
+	NoCache     *bool    `yaml:"no_cache" flag:"no-cache"`
+	Price       *float64 `yaml:"price" flag:"price"`
+	Stats       *string  `yaml:"stats" flag:"stats"`
+	Stream      *bool    `yaml:"stream" flag:"stream"`
+	Progress    *string  `yaml:"progress" flag:"progress"`
+	Structured  *bool    `yaml:"structured" flag:"structured"`
+	NoColor     *bool    `yaml:"no_color" flag:"no-color"`
+
+	IncludeGenerated *bool  `yaml:"include_generated" flag:"include-generated"`
+	IncludeTests     *bool  `yaml:"include_tests" flag:"include-tests"`
+	FollowSymlinks   *bool  `yaml:"follow_symlinks" flag:"follow-symlinks"`
+	NoGitignore      *bool  `yaml:"no_gitignore" flag:"no-gitignore"`
+	SkipUnparseable  *bool  `yaml:"skip_unparseable" flag:"skip-unparseable"`
+	Strict           *bool  `yaml:"strict" flag:"strict"`
+	MaxFileSize      *int64 `yaml:"max_file_size" flag:"max-file-size"`
+	Deterministic    *bool  `yaml:"deterministic" flag:"deterministic"`
+	PackageComment   *bool  `yaml:"package_comment" flag:"package-comment"`
+
+	SystemPromptFile   *string `yaml:"system_prompt_file" flag:"system-prompt-file"`
+	NoSystemPrompt     *bool   `yaml:"no_system_prompt" flag:"no-system-prompt"`
+	ConcurrencyPerHost *int    `yaml:"concurrency_per_host" flag:"concurrency-per-host"`
+
+	// BaseURL overrides the MOONSHOT_BASE_URL environment variable when
+	// no -base-url flag is given.
+	BaseURL string `yaml:"base_url"`
+	// FallbackModels are used when no -fallback-model flags are given.
+	FallbackModels []string `yaml:"fallback_models"`
+	// Headers are extra HTTP headers sent to the API, merged with the
+	// -header flags.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// loadConfig reads the config file at path. When path is empty the default
+// config file is used, and it is not an error for it to be missing.
+func loadConfig(path string) (*fileConfig, error) {
+	required := path != ""
+	if !required {
+		path = defaultConfigFile
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !required && errors.Is(err, os.ErrNotExist) {
+			return &fileConfig{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var cfg fileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// applyConfig sets the flags of fs from cfg, leaving flags that were given
+// explicitly on the command line untouched so that they take precedence.
+func applyConfig(fs *flag.FlagSet, cfg *fileConfig) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("flag")
+		field := v.Field(i)
+		if name == "" || field.IsNil() || explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(field.Elem().Interface())); err != nil {
+			return fmt.Errorf("invalid value for %s in config file: %v", t.Field(i).Tag.Get("yaml"), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffOpKind describes how a line takes part in an edit script.
+type diffOpKind int
+
+const (
+	diffEqual diffOpKind = iota
+	diffDelete
+	diffInsert
+)
+
+// diffOp is a single line of an edit script, with the zero-based line
+// indexes it refers to in the old and new text.
+type diffOp struct {
+	kind diffOpKind
+	a, b int
+	text string
+}
+
+// unifiedDiff returns a unified diff between before and after with git-style
+// headers using path, so that it can be applied with git apply. It returns
+// an empty string when there is no change.
+func unifiedDiff(path, before, after string) string {
+	if before == after {
+		return ""
+	}
+	a := splitLines(before)
+	b := splitLines(after)
+	ops := diffLines(a, b)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n", path, path)
+	fmt.Fprintf(&sb, "--- a/%s\n", path)
+	fmt.Fprintf(&sb, "+++ b/%s\n", path)
+	for _, h := range diffHunks(ops) {
+		writeHunk(&sb, ops[h[0]:h[1]])
+	}
+	return sb.String()
+}
+
+// splitLines splits s into lines, each keeping its trailing newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script from a to b using the Myers
+// algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b, offset)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack walks the recorded Myers traces back from the end of both
+// inputs to recover the edit script.
+func backtrack(trace [][]int, a, b []string, offset int) []diffOp {
+	x, y := len(a), len(b)
+	var ops []diffOp
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{kind: diffEqual, a: x, b: y, text: a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{kind: diffInsert, a: x, b: y, text: b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{kind: diffDelete, a: x, b: y, text: a[x]})
+		}
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// diffHunks groups an edit script into [start, end) ranges of ops, each
+// holding one or more changes plus surrounding context.
+func diffHunks(ops []diffOp) [][2]int {
+	var hunks [][2]int
+	for i := 0; i < len(ops); {
+		if ops[i].kind == diffEqual {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend the hunk over following changes as long as the runs of
+		// equal lines between them are short enough to share context.
+		end, j := i, i
+		for j < len(ops) {
+			if ops[j].kind != diffEqual {
+				j++
+				end = j
+				continue
+			}
+			run := j
+			for run < len(ops) && ops[run].kind == diffEqual {
+				run++
+			}
+			if run == len(ops) || run-j > 2*diffContext {
+				break
+			}
+			j = run
+		}
+
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		hunks = append(hunks, [2]int{start, stop})
+		i = stop
+	}
+	return hunks
+}
+
+// writeHunk writes a single hunk header and body to sb.
+func writeHunk(sb *strings.Builder, ops []diffOp) {
+	var aStart, bStart, aLen, bLen int
+	aStart, bStart = ops[0].a, ops[0].b
+	for _, op := range ops {
+		switch op.kind {
+		case diffEqual:
+			aLen++
+			bLen++
+		case diffDelete:
+			aLen++
+		case diffInsert:
+			bLen++
+		}
+	}
+
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, op := range ops {
+		var prefix string
+		switch op.kind {
+		case diffEqual:
+			prefix = " "
+		case diffDelete:
+			prefix = "-"
+		case diffInsert:
+			prefix = "+"
+		}
+		sb.WriteString(prefix)
+		sb.WriteString(op.text)
+		if !strings.HasSuffix(op.text, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats a hunk range in unified diff notation, where start is
+// zero-based.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elliotxx/gocmt/pkg/gocmt"
+)
+
+// fileOptions controls which Go files are selected for processing.
+type fileOptions struct {
+	// excludes are the -exclude patterns of files and directories to skip.
+	excludes []*globPattern
+	// includeGenerated keeps files marked as generated by a tool.
+	includeGenerated bool
+	// includeTests keeps _test.go files, which are skipped by default.
+	includeTests bool
+	// followSymlinks walks into symlinked directories, which are skipped by
+	// default to avoid cycles.
+	followSymlinks bool
+	// gitignore skips the files that git ignores when walking a directory
+	// inside a git work tree.
+	gitignore bool
+	// maxFileSize is the size in bytes above which files are skipped, zero
+	// means no limit.
+	maxFileSize int64
+	// build, if not nil, skips the files its build constraints exclude,
+	// see buildContext.
+	build *build.Context
+}
+
+// buildContext returns the build context of the current GOOS and GOARCH
+// with the comma-separated build tags, as given to go build -tags.
+func buildContext(tags string) *build.Context {
+	ctx := build.Default
+	ctx.BuildTags = strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	return &ctx
+}
+
+// generatedRe matches the standard marker of generated Go files, see
+// https://go.dev/s/generatedcode.
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGeneratedFile reports whether the Go file at path carries the generated
+// code marker before its package clause.
+func isGeneratedFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if generatedRe.MatchString(line) {
+			return true, nil
+		}
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+	}
+	return false, scanner.Err()
+}
+
+// isGoSource reports whether the file name names a Go source file that gets
+// comments, i.e. a .go file that isn't a test unless tests are included.
+func (o fileOptions) isGoSource(name string) bool {
+	if !strings.HasSuffix(name, ".go") {
+		return false
+	}
+	return o.includeTests || !strings.HasSuffix(name, "_test.go")
+}
+
+// getGoFiles returns the Go files to process in fileOrDirList, walking
+// directories recursively, and the number of Go files skipped because they
+// are excluded, ignored by git, generated or too large.
+func getGoFiles(fileOrDirList []string, fopts fileOptions) ([]string, int, error) {
+	var goFiles []string
+	var skipped int
+	// Deduplicate by real path so that overlapping inputs and symlinks to
+	// the same file don't process (and concurrently write) it twice.
+	seen := make(map[string]bool)
+	addFile := func(path string) error {
+		real, err := realPath(path)
+		if err != nil {
+			real = filepath.Clean(path)
+		}
+		if seen[real] {
+			return nil
+		}
+		seen[real] = true
+
+		if fopts.maxFileSize > 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if info.Size() > fopts.maxFileSize {
+				logger.Debugf("Skipping %s, its size %d exceeds -max-file-size %d", path, info.Size(), fopts.maxFileSize)
+				skipped++
+				return nil
+			}
+		}
+		if !fopts.includeGenerated {
+			generated, err := isGeneratedFile(path)
+			if err != nil {
+				return err
+			}
+			if generated {
+				logger.Debugf("Skipping generated file %s", path)
+				skipped++
+				return nil
+			}
+		}
+		if fopts.build != nil {
+			dir, name := filepath.Split(path)
+			match, err := fopts.build.MatchFile(dir, name)
+			if err != nil {
+				// Leave files whose constraints can't be read to the parser.
+				logger.Debugf("Failed to check the build constraints of %s: %v", path, err)
+			} else if !match {
+				logger.Debugf("Skipping %s excluded by build constraints", path)
+				skipped++
+				return nil
+			}
+		}
+		goFiles = append(goFiles, path)
+		return nil
+	}
+	for _, f := range fileOrDirList {
+		// Check if the specified path is a directory or a file
+		fileInfo, err := os.Stat(f)
+		if err != nil {
+			logger.Debugf("× Error accessing file or directory: %v", err)
+			return nil, 0, err
+		}
+
+		if fileInfo.IsDir() {
+			// If it's a directory, recursively find all Go files
+			var candidates []string
+			err := walk(f, fopts.followSymlinks, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if len(fopts.excludes) > 0 && matchAnyGlob(fopts.excludes, path, info.IsDir()) {
+					logger.Debugf("Excluding %s", path)
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					if strings.HasSuffix(info.Name(), ".go") {
+						skipped++
+					}
+					return nil
+				}
+				if !info.IsDir() && fopts.isGoSource(info.Name()) {
+					candidates = append(candidates, path)
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Debugf("× Error walking directory: %v", err)
+				return nil, 0, err
+			}
+
+			var ignored map[string]bool
+			if fopts.gitignore {
+				ignored, err = gitIgnored(f, candidates)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			for _, path := range candidates {
+				if ignored[path] {
+					logger.Debugf("Skipping %s ignored by git", path)
+					skipped++
+					continue
+				}
+				if err := addFile(path); err != nil {
+					return nil, 0, err
+				}
+			}
+		} else {
+			if fopts.isGoSource(fileInfo.Name()) {
+				if err := addFile(f); err != nil {
+					logger.Debugf("× Error reading file: %v", err)
+					return nil, 0, err
+				}
+			}
+		}
+	}
+	return goFiles, skipped, nil
+}
+
+// realPath returns the absolute path of path with all symlinks resolved.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// walk walks the file tree rooted at root like filepath.Walk, which doesn't
+// follow symlinks. root itself is walked even if it is a symlink to a
+// directory. Symlinked files are passed to fn with the info of the link, and
+// broken symlinks are skipped. Symlinked directories are skipped unless
+// follow is set, in which case they are walked as well, except for those
+// already being walked, so that a link to a parent directory doesn't loop.
+// Paths passed to fn keep the symlinks they were reached through.
+func walk(root string, follow bool, fn filepath.WalkFunc) error {
+	walking := make(map[string]bool)
+	var walkDir func(dir string) error
+	walkDir = func(dir string) error {
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return fn(dir, nil, err)
+		}
+		walking[real] = true
+		return filepath.Walk(real, func(realPath string, info os.FileInfo, err error) error {
+			rel, relErr := filepath.Rel(real, realPath)
+			if relErr != nil {
+				return relErr
+			}
+			path := filepath.Join(dir, rel)
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				return fn(path, info, err)
+			}
+
+			target, err := os.Stat(path)
+			if err != nil {
+				logger.Debugf("Skipping broken symlink %s: %v", path, err)
+				return nil
+			}
+			if !target.IsDir() {
+				return fn(path, info, nil)
+			}
+			if !follow {
+				logger.Debugf("Skipping symlinked directory %s", path)
+				return nil
+			}
+			if targetReal, err := filepath.EvalSymlinks(path); err != nil || walking[targetReal] {
+				logger.Debugf("Skipping symlinked directory %s, it is already being walked", path)
+				return nil
+			}
+			return walkDir(path)
+		})
+	}
+	return walkDir(root)
+}
+
+// readFileList reads the paths listed one per line for -from-file from the
+// file at path, or from stdin for "-". Blank lines are ignored, and listed
+// paths that don't exist, such as the deleted files in the output of git
+// diff --name-only, are skipped.
+func readFileList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		file := strings.TrimSpace(scanner.Text())
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			logger.Debugf("Skipping listed file %s: %v", file, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, scanner.Err()
+}
+
+// goList returns the Go files of the packages matching patterns, such as
+// ./internal/..., as resolved by go list, relative to the current directory
+// where possible. Files whose build constraints exclude them from the build
+// with the given tags aren't listed, and _test.go files only with tests.
+func goList(patterns []string, tags string, tests bool) ([]string, error) {
+	lists := []string{"GoFiles", "CgoFiles"}
+	if tests {
+		lists = append(lists, "TestGoFiles", "XTestGoFiles")
+	}
+	var format strings.Builder
+	for _, list := range lists {
+		fmt.Fprintf(&format, `{{range .%s}}{{$.Dir}}{{"\t"}}{{.}}{{"\n"}}{{end}}`, list)
+	}
+	cmd := exec.Command("go", append([]string{"list", "-tags", tags, "-f", format.String(), "--"}, patterns...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to execute go list: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	logger.Debugf("Go files of packages %s:\n%s", strings.Join(patterns, " "), stdout.String())
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range gitLines(stdout.String()) {
+		dir, name, _ := strings.Cut(line, "\t")
+		file := filepath.Join(dir, name)
+		if rel, err := filepath.Rel(cwd, file); err == nil && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			file = rel
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// gitIgnored returns the paths among paths, which were found by walking dir,
+// that are ignored by the .gitignore files of the git work tree containing
+// dir. Tracked files are never ignored. It returns nil if dir isn't inside a
+// git work tree.
+func gitIgnored(dir string, paths []string) (map[string]bool, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	if _, err := gitCommand("-C", dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		logger.Debugf("Not checking .gitignore, %s is not in a git work tree", dir)
+		return nil, nil
+	}
+
+	realDir, err := realPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The paths are relative to the current directory, which is not
+	// necessarily inside the work tree, so pass them to git relative to dir.
+	var input bytes.Buffer
+	for _, path := range paths {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		// git refuses paths beyond a symbolic link, so files found in a
+		// followed symlinked directory are never ignored.
+		if realParent, err := realPath(filepath.Dir(path)); err != nil || realParent != filepath.Join(realDir, filepath.Dir(rel)) {
+			continue
+		}
+		input.WriteString(rel)
+		input.WriteByte(0)
+	}
+	cmd := exec.Command("git", "-C", dir, "check-ignore", "-z", "--stdin")
+	cmd.Stdin = &input
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Exit status 1 means that none of the paths are ignored.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return nil, fmt.Errorf("failed to execute git check-ignore: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	ignored := make(map[string]bool)
+	for _, rel := range strings.Split(out.String(), "\x00") {
+		if rel != "" {
+			ignored[filepath.Join(dir, rel)] = true
+		}
+	}
+	return ignored, nil
+}
+
+// stagedRef is the -c value that selects the staged changes, as used by a
+// pre-commit hook.
+const stagedRef = "--cached"
+
+// gitDiff returns the existing Go files changed by commitOrRef, which is
+// passed through to git diff, so single commits, ranges such as
+// commitID1...commitID2 and --cached for staged changes all work.
+func gitDiff(commitOrRef string) ([]string, error) {
+	args := append([]string{"diff", "--name-only", "--diff-filter=ACMR"}, diffRange(commitOrRef)...)
+	files, err := gitCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Changed files of %s:\n%s\n", commitOrRef, files)
+	return existingGoFiles(gitLines(files))
+}
+
+// diffRange returns the git diff arguments selecting the changes of
+// commitOrRef, see gitDiff.
+func diffRange(commitOrRef string) []string {
+	if commitOrRef == stagedRef || commitOrRef == "--staged" {
+		return []string{"--cached"}
+	}
+	return []string{commitOrRef, "--"}
+}
+
+// hunkRe matches a hunk header of a unified diff and captures the start and
+// the optional length of the new side, e.g. "@@ -10,2 +12,3 @@".
+var hunkRe = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// gitChangedLines returns the lines changed by commitOrRef in each Go file,
+// for -changed-only. The files are keyed by their path relative to the
+// current directory, as returned by gitDiff, and the lines are those of the
+// new side of the diff. A hunk that only deletes lines marks the line above
+// the deletion, so that the declaration it was deleted from counts as
+// changed.
+func gitChangedLines(commitOrRef string) (map[string][]gocmt.LineRange, error) {
+	// Fix the prefixes and disable anything that changes the format, since
+	// the user's git config may set them.
+	args := append([]string{"diff", "--unified=0", "--diff-filter=ACMR", "--no-color", "--no-ext-diff", "--src-prefix=a/", "--dst-prefix=b/"}, diffRange(commitOrRef)...)
+	diff, err := gitCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	hunks := make(map[string][]gocmt.LineRange)
+	var file, prev string
+	for _, line := range gitLines(diff) {
+		// An added line can start with "++ " as well, but not directly
+		// follow the "--- " line of the old file.
+		isHeader := strings.HasPrefix(line, "+++ ") && strings.HasPrefix(prev, "--- ")
+		prev = line
+		if isHeader {
+			name := strings.TrimPrefix(line, "+++ ")
+			if unquoted, err := strconv.Unquote(name); err == nil {
+				// git quotes paths with unusual characters.
+				name = unquoted
+			}
+			file = strings.TrimPrefix(name, "b/")
+			files = append(files, file)
+			continue
+		}
+		m := hunkRe.FindStringSubmatch(line)
+		if m == nil || file == "" {
+			continue
+		}
+		start, _ := strconv.Atoi(m[1])
+		count := 1
+		if m[2] != "" {
+			count, _ = strconv.Atoi(m[2])
+		}
+		if count == 0 {
+			if start == 0 {
+				continue
+			}
+			count = 1
+		}
+		hunks[file] = append(hunks[file], gocmt.LineRange{Start: start, End: start + count - 1})
+	}
+
+	paths, err := fromTopLevel(files)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string][]gocmt.LineRange, len(files))
+	for i, f := range files {
+		lines[paths[i]] = hunks[f]
+	}
+	return lines, nil
+}
+
+// gitSince returns the existing Go files changed by the commits since the
+// given time, a duration such as 2h or a date git understands such as
+// 2024-05-01, together with the uncommitted changes. Untracked files are
+// included if they were modified since then, which requires a duration or a
+// date in the YYYY-MM-DD form.
+func gitSince(since string) ([]string, error) {
+	var cutoff time.Time
+	if d, err := time.ParseDuration(since); err == nil {
+		cutoff = time.Now().Add(-d)
+		since = cutoff.Format(time.RFC3339)
+	} else if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		cutoff = t
+	}
+	committed, err := gitCommand("log", "--since="+since, "--name-only", "--diff-filter=ACMR", "--pretty=format:")
+	if err != nil {
+		return nil, err
+	}
+	uncommitted, err := gitCommand("diff", "--name-only", "--diff-filter=ACMR", "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Changed files since %s:\n%s\n%s\n", since, committed, uncommitted)
+	changed := append(gitLines(committed), gitLines(uncommitted)...)
+
+	if !cutoff.IsZero() {
+		// List the whole work tree relative to its top-level directory,
+		// like git log does.
+		untracked, err := gitCommand("ls-files", "--others", "--exclude-standard", "--full-name", "--", ":/")
+		if err != nil {
+			return nil, err
+		}
+		topLevel, err := gitCommand("rev-parse", "--show-toplevel")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range gitLines(untracked) {
+			info, err := os.Stat(filepath.Join(topLevel, filepath.FromSlash(f)))
+			if err == nil && !info.ModTime().Before(cutoff) {
+				changed = append(changed, f)
+			}
+		}
+	}
+
+	// The same file may have changed in several commits.
+	seen := make(map[string]bool)
+	var files []string
+	for _, f := range changed {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	return existingGoFiles(files)
+}
+
+// existingGoFiles turns the paths printed by git, which are relative to the
+// top-level directory of the work tree, into paths relative to the current
+// directory, keeping only the Go files that still exist. Deleted and
+// renamed-away paths are skipped rather than failing the whole run. Test
+// files are kept and left to getGoFiles, which handles them like any other
+// file given on the command line.
+func existingGoFiles(files []string) ([]string, error) {
+	var candidates []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".go") {
+			candidates = append(candidates, f)
+		}
+	}
+	paths, err := fromTopLevel(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	// Renames and later commits can leave paths that no longer exist, so
+	// keep only Go files that are still on disk.
+	var goFiles []string
+	for _, f := range paths {
+		if _, err := os.Stat(f); err != nil {
+			logger.Debugf("Skipping changed file %s: %v", f, err)
+			continue
+		}
+		goFiles = append(goFiles, f)
+	}
+	return goFiles, nil
+}
+
+// fromTopLevel turns the paths printed by git, which are relative to the
+// top-level directory of the work tree, into paths relative to the current
+// directory, which may be a subdirectory.
+func fromTopLevel(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	topLevel, err := gitCommand("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(topLevel, filepath.FromSlash(f))
+		if rel, err := filepath.Rel(wd, paths[i]); err == nil {
+			paths[i] = rel
+		}
+	}
+	return paths, nil
+}
+
+// gitLines splits the output of a git command into its non-empty lines.
+// Output without any lines, such as a diff without changes, results in an
+// empty slice rather than a single empty path.
+func gitLines(out string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func gitCommand(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to execute git command: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newGitRepo creates a git repository with the files, given by their
+// slash-separated path, committed, and makes it the working directory for
+// the duration of the test.
+func newGitRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+	git(t, "init", "-q")
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "initial")
+	return dir
+}
+
+// writeFiles creates the files, given by their slash-separated path
+// relative to dir, with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// git runs git with args in the working directory.
+func git(t *testing.T, args ...string) {
+	t.Helper()
+	args = append([]string{"-c", "user.name=gocmt", "-c", "user.email=gocmt@example.com", "-c", "commit.gpgsign=false"}, args...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+func TestGitDiff(t *testing.T) {
+	newGitRepo(t, map[string]string{
+		"a.go":     "package p\n",
+		"b.go":     "package p\n",
+		"c.go":     "package p\n",
+		"README":   "readme\n",
+		"sub/d.go": "package sub\n",
+	})
+
+	// A change, a deletion, a rename and a non-Go file.
+	writeFiles(t, ".", map[string]string{
+		"a.go":     "package p\n\nfunc F() {}\n",
+		"README":   "changed\n",
+		"sub/d.go": "package sub\n\nvar X int\n",
+	})
+	if err := os.Remove("b.go"); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "mv", "c.go", "e.go")
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "change")
+
+	files, err := gitDiff("HEAD~1")
+	if err != nil {
+		t.Fatalf("gitDiff() error = %v", err)
+	}
+	want := []string{"a.go", "e.go", filepath.Join("sub", "d.go")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("gitDiff() = %q, want %q", files, want)
+	}
+}
+
+func TestExistingGoFiles(t *testing.T) {
+	newGitRepo(t, map[string]string{"a.go": "package p\n", "a_test.go": "package p\n"})
+	files, err := existingGoFiles([]string{"a.go", "deleted.go", "a_test.go", "notes.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.go", "a_test.go"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("existingGoFiles() = %q, want %q", files, want)
+	}
+}
+
+func TestGitDiffNoChanges(t *testing.T) {
+	newGitRepo(t, map[string]string{"a.go": "package p\n"})
+	for _, ref := range []string{"HEAD", stagedRef} {
+		files, err := gitDiff(ref)
+		if err != nil {
+			t.Fatalf("gitDiff(%q) error = %v", ref, err)
+		}
+		if len(files) != 0 {
+			t.Errorf("gitDiff(%q) = %q, want none", ref, files)
+		}
+	}
+	files, err := existingGoFiles(nil)
+	if err != nil || len(files) != 0 {
+		t.Errorf("existingGoFiles(nil) = %q, %v, want none", files, err)
+	}
+}
+
+func TestGitLines(t *testing.T) {
+	tests := []struct {
+		out  string
+		want []string
+	}{
+		{"", nil},
+		{"a.go", []string{"a.go"}},
+		{"a.go\nb.go\n", []string{"a.go", "b.go"}},
+		{"a.go\r\n\r\nb.go", []string{"a.go", "b.go"}},
+	}
+	for _, tt := range tests {
+		if got := gitLines(tt.out); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("gitLines(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The formatters selectable with -formatter.
+const (
+	formatterGofmt   = "gofmt"
+	formatterGofumpt = "gofumpt"
+)
+
+// newFormatter returns the function formatting the final code for the
+// -formatter name, or nil for the built-in gofmt formatting. gofumpt is run
+// as an external binary that must be on the PATH.
+func newFormatter(name string) (func(string) (string, error), error) {
+	switch name {
+	case formatterGofmt:
+		return nil, nil
+	case formatterGofumpt:
+		path, err := exec.LookPath(formatterGofumpt)
+		if err != nil {
+			return nil, fmt.Errorf("-formatter gofumpt needs the gofumpt binary on the PATH, install it with go install mvdan.cc/gofumpt@latest")
+		}
+		return func(code string) (string, error) {
+			return runFormatter(path, code)
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid formatter %q, must be one of: gofmt, gofumpt", name)
+}
+
+// runFormatter pipes code through the formatter binary at path.
+func runFormatter(path, code string) (string, error) {
+	cmd := exec.Command(path)
+	cmd.Stdin = strings.NewReader(code)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to run %s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globPattern is a compiled -exclude pattern. In addition to the syntax of
+// path.Match, "**" matches any number of path segments.
+type globPattern struct {
+	re *regexp.Regexp
+	// baseOnly is set for patterns without a slash, which are matched
+	// against the base name only, e.g. "*_mock.go".
+	baseOnly bool
+}
+
+// compileGlobs compiles the given glob patterns.
+func compileGlobs(patterns []string) ([]*globPattern, error) {
+	globs := make([]*globPattern, 0, len(patterns))
+	for _, p := range patterns {
+		g, err := compileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+// compileGlob translates a glob pattern into an anchored regular expression.
+func compileGlob(pattern string) (*globPattern, error) {
+	p := strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid exclude pattern %q: unterminated character class", pattern)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+	}
+	return &globPattern{re: re, baseOnly: !strings.Contains(p, "/")}, nil
+}
+
+// match reports whether the slash-separated path p matches the pattern. A
+// pattern containing a slash may match the path or any trailing run of its
+// segments, so that "vendor/**" matches "a/vendor/b.go" as well.
+func (g *globPattern) match(p string) bool {
+	if g.baseOnly {
+		return g.re.MatchString(path.Base(p))
+	}
+	for {
+		if g.re.MatchString(p) {
+			return true
+		}
+		i := strings.IndexByte(p, '/')
+		if i < 0 {
+			return false
+		}
+		p = p[i+1:]
+	}
+}
+
+// matchAnyGlob reports whether path matches any of the patterns. Directories
+// are matched with a trailing slash so that "dir/**" prunes dir itself.
+func matchAnyGlob(globs []*globPattern, p string, isDir bool) bool {
+	p = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(p)), "./")
+	for _, g := range globs {
+		if g.match(p) || (isDir && !g.baseOnly && g.match(p+"/")) {
+			return true
+		}
+	}
+	return false
+}
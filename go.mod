@@ -2,4 +2,7 @@ module github.com/elliotxx/gocmt
 
 go 1.19
 
-require github.com/sashabaranov/go-openai v1.20.5
+require (
+	github.com/sashabaranov/go-openai v1.20.5
+	gopkg.in/yaml.v3 v3.0.1
+)
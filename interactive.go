@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/elliotxx/gocmt/pkg/gocmt"
+)
+
+// reviewer asks the user on the terminal whether to accept each proposed
+// comment, for -interactive.
+type reviewer struct {
+	in *bufio.Reader
+}
+
+// newReviewer returns a reviewer reading the answers from r.
+func newReviewer(r io.Reader) *reviewer {
+	return &reviewer{in: bufio.NewReader(r)}
+}
+
+// approve shows the declaration and the proposed comment and prompts until
+// the comment is accepted, rejected or edited. It implements
+// gocmt.Options.Approve.
+func (r *reviewer) approve(p gocmt.Proposal) (string, bool) {
+	logger.Printf("\n» %s\n", p.Name)
+	for _, line := range strings.Split(strings.TrimRight(p.Code, "\n"), "\n") {
+		logger.Printf("    %s\n", line)
+	}
+	text := p.Text
+	for {
+		for _, line := range strings.Split(text, "\n") {
+			logger.Printf("  // %s\n", line)
+		}
+		logger.Printf("Add this comment? [y]es, [n]o, [e]dit: ")
+		answer, err := r.in.ReadString('\n')
+		if err != nil && answer == "" {
+			// Without input there is nobody to approve the comment.
+			logger.Printf("\n")
+			return "", false
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return text, true
+		case "n", "no":
+			return "", false
+		case "e", "edit":
+			edited, err := editText(text)
+			if err != nil {
+				logger.Errorf("× Error: %v\n", err)
+				continue
+			}
+			if edited == "" {
+				return "", false
+			}
+			text = edited
+		}
+	}
+}
+
+// editText opens text in $EDITOR, vi if unset, and returns the edited
+// text with surrounding whitespace removed.
+func editText(text string) (string, error) {
+	f, err := os.CreateTemp("", "gocmt-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(text + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// EDITOR may carry arguments, e.g. "code --wait".
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], f.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to run editor %s: %v", editor, err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/elliotxx/gocmt/pkg/gocmt"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// stubClient is a gocmt.ChatClient answering every request with content.
+type stubClient struct {
+	content string
+}
+
+func (c stubClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: c.content},
+		}},
+	}, nil
+}
+
+func (c stubClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
+	return nil, errors.New("streaming is not supported by the stub client")
+}
+
+// shapesResponse comments every declaration of testdata/lint/shapes the way
+// a model might, with openings that don't name the declaration. Comments for
+// declarations in another file than the one sent are left unmatched.
+const shapesResponse = `{"comments": [
+	{"position": "package shapes", "comment": "This package provides geometric shapes."},
+	{"position": "type Shape interface {", "comment": "Describes anything with an area."},
+	{"position": "type Circle struct {", "comment": "A Circle is a round shape."},
+	{"position": "func (c Circle) Area() float64 {", "comment": "Circle.Area returns the area of the circle."},
+	{"position": "type Rect struct{ W, H float64 }", "comment": "The type holds a rectangle."},
+	{"position": "func (r *Rect) Area() float64 {", "comment": "Returns the area of the rectangle."},
+	{"position": "func NewRect(w, h float64) *Rect {", "comment": "This function creates a rectangle."},
+	{"position": "func scale(s float64) float64 {", "comment": "Scales s."},
+	{"position": "const Unit", "comment": "The unit length."},
+	{"position": "const Zero", "comment": "Zero is no length."},
+	{"position": "var DefaultCircle", "comment": "The circle of unit radius."},
+	{"position": "const Max = 100", "comment": "Largest size."}
+]}`
+
+// lintExported reports the exported-symbol doc warnings of revive and golint
+// for the package in dir: a missing package comment or doc comment, and doc
+// comments that don't start with the name they document.
+func lintExported(t *testing.T, dir string) []string {
+	t.Helper()
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for name, pkg := range pkgs {
+		var files []*ast.File
+		var paths []string
+		for path, file := range pkg.Files {
+			files = append(files, file)
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			issues, err := gocmt.CheckDocs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, issue := range issues {
+				warnings = append(warnings, issue.String())
+			}
+			warnings = append(warnings, lintValues(fset, pkg.Files[path])...)
+		}
+
+		p, err := doc.NewFromFiles(fset, files, "example.com/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(p.Doc, "Package "+name+" ") {
+			warnings = append(warnings, "package comment should be of the form \"Package "+name+" ...\", got "+quoteDoc(p.Doc))
+		}
+		check := func(name, text string) {
+			if text != "" && !strings.HasPrefix(text, name+" ") && !hasArticlePrefix(text, name) {
+				warnings = append(warnings, "comment on exported "+name+" should be of the form \""+name+" ...\", got "+quoteDoc(text))
+			}
+		}
+		for _, f := range p.Funcs {
+			check(f.Name, f.Doc)
+		}
+		for _, typ := range p.Types {
+			check(typ.Name, typ.Doc)
+			for _, f := range typ.Funcs {
+				check(f.Name, f.Doc)
+			}
+			for _, m := range typ.Methods {
+				check(m.Name, m.Doc)
+			}
+		}
+	}
+	return warnings
+}
+
+// lintValues checks that the doc comments of exported variables and
+// constants start with their name. go/doc only keeps the doc comment of the
+// declaration, not those of the specs of a group.
+func lintValues(fset *token.FileSet, file *ast.File) []string {
+	var warnings []string
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || (gd.Tok != token.CONST && gd.Tok != token.VAR) {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			name := vs.Names[0].Name
+			text := vs.Doc.Text()
+			if !gd.Lparen.IsValid() {
+				text = gd.Doc.Text()
+			}
+			if ast.IsExported(name) && text != "" && !strings.HasPrefix(text, name+" ") {
+				warnings = append(warnings, fset.Position(vs.Pos()).String()+": comment on exported "+gd.Tok.String()+" "+name+" should be of the form \""+name+" ...\", got "+quoteDoc(text))
+			}
+		}
+	}
+	return warnings
+}
+
+// hasArticlePrefix reports whether text starts with name after an article,
+// which golint accepts for types.
+func hasArticlePrefix(text, name string) bool {
+	for _, article := range []string{"A ", "An ", "The "} {
+		if strings.HasPrefix(text, article+name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteDoc returns the first line of a doc comment, quoted.
+func quoteDoc(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return "\"" + line + "\""
+}
+
+// copyDir copies the files of the directory src into dst.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLintExported(t *testing.T) {
+	dir := t.TempDir()
+	copyDir(t, filepath.Join("testdata", "lint", "shapes"), dir)
+	if warnings := lintExported(t, dir); len(warnings) == 0 {
+		t.Fatal("fixture has no lint warnings to fix")
+	}
+
+	gen, err := gocmt.NewCommentGenerator(gocmt.Options{
+		Client:     stubClient{content: shapesResponse},
+		GodocStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packageFiles := gocmt.PackageCommentFiles(files)
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generate := gen.Generate
+		if packageFiles[file] {
+			generate = gen.GenerateWithPackageComment
+		}
+		result, err := generate(context.Background(), string(src))
+		if err != nil {
+			t.Fatalf("Generate(%s) error = %v", filepath.Base(file), err)
+		}
+		if err := os.WriteFile(file, []byte(result.Code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, warning := range lintExported(t, dir) {
+		t.Error(warning)
+	}
+	if t.Failed() {
+		for _, file := range files {
+			code, _ := os.ReadFile(file)
+			t.Logf("%s:\n%s", filepath.Base(file), code)
+		}
+	}
+}
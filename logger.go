@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// verbosity controls how much output is printed to the console.
+type verbosity int
+
+const (
+	// verbosityQuiet prints only errors and the final summary.
+	verbosityQuiet verbosity = iota
+	// verbosityNormal additionally prints per-file progress.
+	verbosityNormal
+	// verbosityVerbose additionally echoes the log lines to stderr.
+	verbosityVerbose
+)
+
+// leveledLogger routes debug lines to the log file and user-facing messages
+// to the console according to its verbosity.
+type leveledLogger struct {
+	mu        sync.Mutex
+	verbosity verbosity
+	// console receives user-facing messages, normally stdout.
+	console io.Writer
+	// stderr receives the echoed log lines in verbose mode.
+	stderr io.Writer
+	// logToStderr is set when the log itself goes to stderr, in which case
+	// verbose mode doesn't echo the lines a second time.
+	logToStderr bool
+	// secrets are masked in every message, see redact.
+	secrets []string
+	// color colors the console messages by their marker when the console
+	// is a terminal.
+	color bool
+	// status is the line kept at the bottom of a terminal console, such as
+	// the progress bar, see setStatus.
+	status string
+}
+
+// logger is the logger used throughout gocmt.
+var logger = &leveledLogger{
+	verbosity: verbosityNormal,
+	console:   os.Stdout,
+	stderr:    os.Stderr,
+}
+
+// setupLogFile directs the log to the file at path. An empty path or "off"
+// disables file logging, and if the file can't be opened the log falls back
+// to stderr with a warning. The returned function closes the log file.
+func (l *leveledLogger) setupLogFile(path string) func() {
+	if path == "" || path == "off" {
+		log.SetOutput(io.Discard)
+		return func() {}
+	}
+
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		l.write(l.stderr, fmt.Sprintf("Warning: failed to open log file, logging to stderr instead: %v\n", err))
+		log.SetOutput(l.stderr)
+		l.logToStderr = true
+		return func() {}
+	}
+	log.SetOutput(logFile)
+	return func() {
+		logFile.Close()
+	}
+}
+
+// redactedMask replaces secrets in the output.
+const redactedMask = "[REDACTED]"
+
+// bearerRe matches the credentials of a Bearer authorization header. Values
+// shorter than 8 characters aren't credentials but prose such as "bearer
+// token", which masking would only garble.
+var bearerRe = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]{8,}`)
+
+// addSecret makes the logger mask secret, such as the API key, in all
+// messages it writes, however short it is. Log files end up in bug reports.
+func (l *leveledLogger) addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, secret)
+}
+
+// redact returns msg with the registered secrets and any Bearer tokens
+// masked.
+func (l *leveledLogger) redact(msg string) string {
+	l.mu.Lock()
+	secrets := l.secrets
+	l.mu.Unlock()
+	for _, secret := range secrets {
+		msg = strings.ReplaceAll(msg, secret, redactedMask)
+	}
+	return bearerRe.ReplaceAllString(msg, "${1}"+redactedMask)
+}
+
+// Debugf writes a line to the log file, and to stderr in verbose mode.
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	msg := l.redact(fmt.Sprintf(format, args...))
+	_ = log.Output(2, msg)
+	if l.verbosity >= verbosityVerbose && !l.logToStderr {
+		l.write(l.stderr, strings.TrimRight(msg, "\n")+"\n")
+	}
+}
+
+// Infof prints a progress message to the console unless in quiet mode.
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	if l.verbosity >= verbosityNormal {
+		l.write(l.console, fmt.Sprintf(format, args...))
+	}
+}
+
+// Errorf prints an error message to the console and the log file.
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	msg := l.redact(fmt.Sprintf(format, args...))
+	_ = log.Output(2, strings.TrimRight(msg, "\n"))
+	l.write(l.console, msg)
+}
+
+// Printf prints a message to the console regardless of verbosity, e.g. the
+// final summary.
+func (l *leveledLogger) Printf(format string, args ...interface{}) {
+	l.write(l.console, fmt.Sprintf(format, args...))
+}
+
+// clearLine moves the cursor to the start of the line and clears it.
+const clearLine = "\r\x1b[K"
+
+// setStatus shows msg, a single line without a newline, as the status line
+// at the bottom of the console, updating it in place. Messages written
+// meanwhile are printed above it. If the console isn't a terminal, msg is
+// printed as a line of its own instead. Nothing is printed in quiet mode.
+func (l *leveledLogger) setStatus(msg string) {
+	if l.verbosity < verbosityNormal {
+		return
+	}
+	if !isTerminal(l.console) {
+		l.write(l.console, msg+"\n")
+		return
+	}
+	msg = l.redact(msg)
+	if l.color {
+		msg = colorize(msg)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.status = msg
+	_, _ = io.WriteString(l.console, clearLine+msg)
+}
+
+// endStatus leaves the status line as it is and moves to the next line, so
+// that later messages are printed below it.
+func (l *leveledLogger) endStatus() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.status == "" {
+		return
+	}
+	l.status = ""
+	_, _ = io.WriteString(l.console, "\n")
+}
+
+// write writes msg to w with the secrets masked, serializing writes from
+// concurrent workers.
+func (l *leveledLogger) write(w io.Writer, msg string) {
+	msg = l.redact(msg)
+	terminal := w == l.console && isTerminal(w)
+	if l.color && terminal {
+		msg = colorize(msg)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if terminal && l.status != "" {
+		// Print the message in place of the status line and draw the
+		// status line again below it once the message line is complete.
+		msg = clearLine + msg
+		if strings.HasSuffix(msg, "\n") {
+			msg += l.status
+		}
+	}
+	_, _ = io.WriteString(w, msg)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// newTestLogger returns a verbose logger writing its console messages,
+// stderr echo and log file to the returned buffers.
+func newTestLogger(t *testing.T) (l *leveledLogger, console, stderr, logFile *bytes.Buffer) {
+	t.Helper()
+	console, stderr, logFile = new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+	log.SetOutput(logFile)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	l = &leveledLogger{verbosity: verbosityVerbose, console: console, stderr: stderr}
+	return l, console, stderr, logFile
+}
+
+func TestLoggerRedact(t *testing.T) {
+	const key = "sk-0123456789abcdef"
+	tests := []struct {
+		name   string
+		secret string
+		msg    string
+		want   string
+		leaked string
+	}{
+		{
+			name:   "API key",
+			secret: key,
+			msg:    "client config: key=" + key + " model=m",
+			want:   "client config: key=[REDACTED] model=m",
+			leaked: key,
+		},
+		{
+			name:   "authorization header",
+			msg:    "request headers: Authorization: Bearer abc.DEF-123_xyz",
+			want:   "request headers: Authorization: Bearer [REDACTED]",
+			leaked: "abc.DEF-123_xyz",
+		},
+		{
+			name:   "lowercase bearer",
+			msg:    "authorization: bearer tok123456",
+			want:   "authorization: bearer [REDACTED]",
+			leaked: "tok123456",
+		},
+		{
+			name:   "short token",
+			secret: "sk-1",
+			msg:    "client config: key=sk-1 model=m",
+			want:   "client config: key=[REDACTED] model=m",
+			leaked: "sk-1",
+		},
+		{
+			name: "short bearer value",
+			msg:  "authorization: bearer token missing",
+			want: "authorization: bearer token missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, console, stderr, logFile := newTestLogger(t)
+			l.addSecret(tt.secret)
+			l.Debugf("%s", tt.msg)
+			l.Errorf("%s\n", tt.msg)
+			l.Printf("%s\n", tt.msg)
+			outputs := map[string]*bytes.Buffer{"console": console, "stderr": stderr, "log file": logFile}
+			for name, buf := range outputs {
+				if !strings.Contains(buf.String(), tt.want) {
+					t.Errorf("%s output %q doesn't contain %q", name, buf.String(), tt.want)
+				}
+				if tt.leaked != "" && strings.Contains(buf.String(), tt.leaked) {
+					t.Errorf("%s output %q leaks %q", name, buf.String(), tt.leaked)
+				}
+			}
+		})
+	}
+}
@@ -1,47 +1,43 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"go/ast"
-	"go/format"
-	"go/parser"
-	"go/token"
 	"io"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
-	openai "github.com/sashabaranov/go-openai"
+	"github.com/elliotxx/gocmt/pkg/gocmt"
 )
 
-// NewMoonShotClient creates a new MoonShot API client.
-func NewMoonShotClient(baseURL, authToken string) *openai.Client {
-	config := openai.DefaultConfig(authToken)
-	if len(baseURL) == 0 {
-		config.BaseURL = "https://api.moonshot.cn/v1"
-	} else {
-		config.BaseURL = baseURL
-	}
-	return openai.NewClientWithConfig(config)
-}
+// defaultConcurrency is the number of files processed concurrently when -n
+// isn't given. Processing is bound by network latency rather than CPU, so a
+// small fixed number works well regardless of the machine.
+const defaultConcurrency = 4
 
-type CommentJSON struct {
-	Comments []Comment `json:"comments"`
+// stringSlice is a flag.Value that collects the values of a repeatable flag.
+type stringSlice []string
+
+// String returns the values joined by commas.
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
 }
 
-// Comment represents the structure of a comment in the JSON.
-type Comment struct {
-	Position string `json:"position"`
-	Comment  string `json:"comment"`
+// Set appends a value each time the flag is given.
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 func printHelp() {
@@ -49,39 +45,343 @@ func printHelp() {
 
 Options:
   -f  string
-    File or directory containing Go code.
+    File or directory containing Go code, or - to read from stdin and write to stdout.
+    Can be repeated to process several paths.
   -c  string
-    Specify a commit hash or reference (e.g., HEAD, HEAD^, commitID1...commitID2)
+    Specify a commit hash or reference (e.g., HEAD, HEAD^, commitID1...commitID2, --cached)
+  -staged  bool
+    Process the Go files in the staged changes, same as -c --cached
+  -base  string
+    Process the Go files changed on -head since it branched off this ref,
+    same as -c base...head, e.g. for the target branch of a pull request
+  -head  string
+    The ref whose changes -base selects (default "HEAD")
+  -changed-only  bool
+    With -c, -staged or -base, only comment the declarations overlapping the
+    changed lines instead of all declarations in the changed files
+  -since  string
+    Process the Go files changed by the commits since a duration ago or a
+    date (e.g., 2h, 2024-05-01), and the uncommitted changes
+  -from-file  string
+    Process the files and directories listed one per line in this file, or
+    - to read the list from stdin (e.g., git diff --name-only | gocmt -from-file -);
+    listed paths that don't exist are skipped
+  -pkg  string
+    Process the Go files of the packages matching this go list pattern,
+    e.g. ./internal/..., can be repeated; only the files of the current
+    build are included
+  -exclude  string
+    Glob pattern of files or directories to skip, can be repeated.
+    "**" matches any number of directories, e.g. vendor/**, *_mock.go
+  -include-generated  bool
+    Also process files marked with a "Code generated ... DO NOT EDIT." comment
+  -include-tests  bool
+    Also process _test.go files, e.g. to document the helpers of a shared
+    test-support package
+  -tags  string
+    Only process the files that are part of the build for these
+    comma-separated build tags and the current GOOS and GOARCH, like
+    go build -tags; -tags "" selects the files of the plain build
+  -follow-symlinks  bool
+    Walk into symlinked directories, which are skipped by default; links
+    back into a directory being walked are not followed again. Symlinked
+    files are always processed, once per real file
+  -no-gitignore  bool
+    Also process files ignored by git when walking directories inside a git
+    repository, which are skipped by default
+  -max-file-size  int
+    Skip files larger than this many bytes, 0 disables the limit (default 262144)
   -n  int
-    Number of concurrent executions
+    Number of concurrent executions (default 4)
+  -dry-run  bool
+    Print a unified diff of the changes instead of writing files
+  -summary  bool
+    With -dry-run, print the number of comments each file would get and
+    the total instead of the diffs
+  -interactive  bool
+    Review each generated comment and accept, reject or edit it ($EDITOR)
+    before it is added; files are processed one at a time
+  -backup  bool
+    Write the original contents to <file>.bak before overwriting
+  -patch  string
+    Write a patch with the changes of all files to the given file, to be
+    applied with git apply, instead of writing the files
+  -output-dir  string
+    Write the commented copies of the files to this directory instead of
+    overwriting them, keeping their paths relative to the -f directories
+    (or to the current directory for -c, -staged and -since)
+  -state  string
+    Record the content hash of each processed file in this JSON file, e.g.
+    .gocmt-state.json, and skip the files that are unchanged since on later
+    runs, without calling the model
+  -force  bool
+    With -state, process all files again even if they are unchanged
+  -skip-unparseable  bool
+    Skip files with syntax errors with a warning instead of counting them as
+    failed, disable with -skip-unparseable=false (default true)
+  -strict  bool
+    Count a file as failed, leaving it unchanged, when the model returns
+    comments for positions that match no declaration instead of only warning
+  -fail-fast  bool
+    Stop at the first file that fails instead of processing the remaining files
+  -scope  string
+    Which declarations to comment: exported, unexported or all (default "all")
+  -match  string
+    Only comment declarations whose name matches this regular expression,
+    e.g. ^Handle; methods are matched by name without the receiver
+  -max-comments  int
+    Add at most this many comments per file, preferring exported
+    declarations, 0 means no limit
+  -overwrite  bool
+    Replace existing doc comments instead of skipping them
+  -fields  bool
+    Also comment the exported fields of structs that have no comment
+    (uses more tokens)
+  -keep-imports  bool
+    Send the package clause and the imports along with the code, so that
+    comments can refer to the dependencies used
+  -keep-bodies  bool
+    Send the function bodies instead of only the signatures, for comments
+    that describe what the code does (uses many more tokens)
+  -explain  bool
+    Add a short paragraph on how and why the function works to the
+    comments of complex functions (uses more tokens)
+  -formatter  string
+    Formatter applied to the result: gofmt, or gofumpt which must be
+    installed (default "gofmt")
+  -no-reformat  bool
+    Only insert the comments and leave the rest of the file as it is,
+    instead of formatting the whole file like gofmt
+  -wrap  int
+    Column at which generated comments are wrapped, 0 disables wrapping (default 80)
+  -style  string
+    Comment style of comments of more than one line: line for // on every
+    line, or block for a /* */ block (default "line")
+  -godoc-style  bool
+    Make each comment start with the name of the declaration it describes,
+    disable with -godoc-style=false (default true)
+  -package-comment  bool
+    Add a package comment to packages that have none, in their doc.go, the
+    file named after the package or else their first file
+  -lang  string
+    Language of the generated comments (e.g., en, zh, ja) (default "en")
+  -rpm  int
+    Maximum number of requests to the model per minute across all
+    concurrent files, 0 means no limit
+  -timeout  duration
+    Timeout for each request to the model, 0 disables it (default 1m0s)
+  -proxy  string
+    URL of the HTTP proxy used to reach the API, e.g. http://proxy:8080
+    (default from the HTTPS_PROXY and HTTP_PROXY environment variables)
+  -concurrency-per-host  int
+    Maximum number of connections to the API host; further requests wait
+    for a free connection, 0 means no limit. Idle connections are kept for
+    reuse up to -n
+  -header  string
+    Extra HTTP header sent to the API as Name=Value, e.g.
+    OpenAI-Organization=org_123, can be repeated
+  -provider  string
+    API provider: moonshot, or local for an OpenAI-compatible server such
+    as Ollama or LM Studio, which needs -base-url and -model but no API key
+    (default "moonshot")
+  -base-url  string
+    Base URL of the API, e.g. http://localhost:11434/v1 for Ollama
+    (default from the MOONSHOT_BASE_URL environment variable)
+  -model  string
+    Model used to generate comments (default "moonshot-v1-8k")
+  -fallback-model  string
+    Model to use when the previous one is still overloaded (429 or 5xx
+    gateway errors) after two retries, can be repeated to build a chain
+  -temperature  float
+    Sampling temperature of the model (default 0.3)
+  -deterministic  bool
+    Use a fixed seed and the smallest positive temperature
+    (math.SmallestNonzeroFloat32, about 1.4e-45), which samples like 0 (a
+    0 is left out of the request and means the provider's default),
+    overriding -temperature, for output that is as reproducible as the
+    provider allows. OpenAI and Ollama honor the seed on a
+    best-effort basis; providers that don't support it, such as Moonshot,
+    ignore it. Combine with the cache for stable snapshots
+  -prompt-file  string
+    Custom prompt template file, {{.Code}} is replaced with the code
+    and {{.Language}} with the comment language. It is sent as the user
+    message, alone unless -system-prompt-file is given too
+  -system-prompt-file  string
+    Custom system prompt template file replacing the built-in instructions,
+    {{.Language}} is replaced with the comment language
+  -no-system-prompt  bool
+    Send the instructions and the code in a single user message instead of
+    putting the instructions in a system message, for models that ignore
+    system messages
+  -no-cache  bool
+    Disable the response cache (stored in the user cache directory, e.g. ~/.cache/gocmt)
+  -clear-cache  bool
+    Remove all cached responses
+  -stream  bool
+    Use the streaming API and show the bytes received while waiting
+    (token usage isn't reported for streamed responses)
+  -progress  string
+    Progress format: text for a progress bar with the throughput and the
+    estimated time left (a line per file when not on a terminal), or json
+    to write a line of JSON such as
+    {"file":"x.go","status":"done","completed":3,"total":10} to stdout as
+    each file finishes, with the other messages on stderr (default "text")
+  -structured  bool
+    Have the model return the comments through a tool call with a JSON
+    schema instead of plain text (requires a model that supports tools)
+  -list  bool
+    Print the files that would be processed, one per line, and exit
+    without calling the model
+  -check  bool
+    Report exported declarations without doc comments and exit non-zero
+    if any, without calling the model
+  -price  float
+    Price in USD per 1K tokens, used to estimate the cost of a run
+  -stats  string
+    Write a JSON report of the run to this file: the status, comments
+    added, tokens, latency and model of each file, and the totals
+  -config  string
+    Config file with flag defaults (default ".gocmt.yaml" if present)
+  -env-file  string
+    File with KEY=VALUE lines setting environment variables such as
+    MOONSHOT_API_KEY that aren't already set (default ".env" if present)
+  -log  string
+    Log file path, empty or "off" disables file logging (default "logfile.log")
+  -v  bool
+    Verbose output, echo the log lines to stderr
+  -q  bool
+    Quiet output, only print errors and the final summary
+  -no-color  bool
+    Disable colored output, which is also off when the output isn't a
+    terminal or the NO_COLOR environment variable is set
+  -version  bool
+    Print the version, git commit and build date and exit, same as
+    gocmt version
   -h  bool
     Show this help message and exit
 
+Configuration:
+  Defaults can be set in a YAML config file (.gocmt.yaml in the current
+  directory, or the file given by -config), e.g.:
+
+    concurrency: 4
+    model: moonshot-v1-32k
+    temperature: 0.2
+    lang: zh
+    timeout: 2m
+    base_url: https://api.moonshot.cn/v1
+    proxy: http://proxy.example.com:8080
+    headers:
+      OpenAI-Organization: org_123
+    log: off
+
+  Precedence: flags > config file > environment variables > built-in defaults.
+
 Examples:
   gocmt -f /path/to/example.go
   gocmt -f /path/to/dir/
+  gocmt -f a.go -f /path/to/dir/
+  gocmt -f /path/to/dir/ -exclude 'vendor/**' -exclude '*_mock.go'
   gocmt -c HEAD
   gocmt -c HEAD^
   gocmt -c commitID1...commitID2
+  gocmt -staged
+  gocmt -base main -head feature
+  gocmt -base main -changed-only
+  gocmt -since 2h
+  gocmt -f /path/to/dir/ -dry-run
+  gocmt -f /path/to/dir/ -patch gocmt.patch
+  gocmt -f /path/to/dir/ -lang zh
+  gocmt -f /path/to/dir/ -check
+  gocmt -c HEAD -exclude 'vendor/**' -list
+  cat example.go | gocmt -f - > example.commented.go
 `
 	fmt.Println(helpText)
 }
 
 func main() {
-	// Setting up logger
-	logFile, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("Failed to open log file:", err)
-		return
-	}
-	defer logFile.Close()
-
-	log.SetOutput(io.MultiWriter(logFile))
+	// Nothing is logged until the log file is set up below.
+	log.SetOutput(io.Discard)
 
 	// Parse command line arguments
-	concurrency := flag.Int("n", 1, "Number of concurrent executions")
-	fileOrDir := flag.String("f", "", "File or directory containing Go code")
-	commitFlag := flag.String("c", "", "Specify a commit hash or reference (e.g., HEAD, HEAD^, commitID1...commitID2)")
+	concurrency := flag.Int("n", defaultConcurrency, "Number of concurrent executions")
+	var fileOrDir stringSlice
+	flag.Var(&fileOrDir, "f", "File or directory containing Go code, can be repeated")
+	var excludeFlag stringSlice
+	flag.Var(&excludeFlag, "exclude", "Glob pattern of files or directories to skip, can be repeated")
+	includeGenerated := flag.Bool("include-generated", false, "Also process files marked with a \"Code generated ... DO NOT EDIT.\" comment")
+	includeTests := flag.Bool("include-tests", false, "Also process _test.go files")
+	tags := flag.String("tags", "", "Only process the files that are part of the build for these comma-separated build tags")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Walk into symlinked directories, which are skipped by default")
+	noGitignore := flag.Bool("no-gitignore", false, "Also process files ignored by .gitignore when walking directories")
+	maxFileSize := flag.Int64("max-file-size", 256*1024, "Skip files larger than this many bytes, 0 disables the limit")
+	commitFlag := flag.String("c", "", "Specify a commit hash or reference (e.g., HEAD, HEAD^, commitID1...commitID2, --cached)")
+	since := flag.String("since", "", "Process the Go files changed since a duration ago or a date (e.g., 2h, 2024-05-01)")
+	var pkgPatterns stringSlice
+	flag.Var(&pkgPatterns, "pkg", "Process the Go files of the packages matching this go list pattern, can be repeated")
+	fromFile := flag.String("from-file", "", "Process the paths listed one per line in this file, or - for stdin")
+	base := flag.String("base", "", "Process the Go files changed on -head since it branched off this ref, same as -c base...head")
+	head := flag.String("head", "", "The ref whose changes -base selects, HEAD if empty")
+	changedOnly := flag.Bool("changed-only", false, "With -c, -staged or -base, only comment the declarations overlapping the changed lines")
+	staged := flag.Bool("staged", false, "Process the Go files in the staged changes, same as -c --cached")
+	dryRun := flag.Bool("dry-run", false, "Print a unified diff of the changes instead of writing files")
+	summary := flag.Bool("summary", false, "With -dry-run, print the number of comments per file instead of the diffs")
+	interactive := flag.Bool("interactive", false, "Review each generated comment and accept, reject or edit it before it is added")
+	rpm := flag.Int("rpm", 0, "Maximum number of requests to the model per minute, 0 means no limit")
+	timeout := flag.Duration("timeout", 60*time.Second, "Timeout for each request to the model, 0 disables it")
+	var headerFlag stringSlice
+	flag.Var(&headerFlag, "header", "Extra HTTP header sent to the API as Name=Value, can be repeated")
+	concurrencyPerHost := flag.Int("concurrency-per-host", 0, "Maximum number of connections to the API host, 0 means no limit")
+	proxy := flag.String("proxy", "", "URL of the HTTP proxy used to reach the API (default from HTTPS_PROXY and HTTP_PROXY)")
+	lang := flag.String("lang", "en", "Language of the generated comments (e.g., en, zh, ja)")
+	scopeFlag := flag.String("scope", "all", "Which declarations to comment: exported, unexported or all")
+	matchFlag := flag.String("match", "", "Only comment declarations whose name matches this regular expression")
+	maxComments := flag.Int("max-comments", 0, "Add at most this many comments per file, preferring exported declarations, 0 means no limit")
+	overwrite := flag.Bool("overwrite", false, "Replace existing doc comments instead of skipping them")
+	fields := flag.Bool("fields", false, "Also comment the exported fields of structs that have no comment")
+	keepImports := flag.Bool("keep-imports", false, "Send the package clause and the imports along with the code")
+	keepBodies := flag.Bool("keep-bodies", false, "Send the function bodies instead of only the signatures (uses many more tokens)")
+	explain := flag.Bool("explain", false, "Add a paragraph on how and why to the comments of complex functions (uses more tokens)")
+	styleFlag := flag.String("style", "line", "Comment style of comments of more than one line: line or block")
+	godocStyle := flag.Bool("godoc-style", true, "Make each comment start with the name of the declaration it describes")
+	packageComment := flag.Bool("package-comment", false, "Add a package comment to packages that have none")
+	formatterFlag := flag.String("formatter", formatterGofmt, "Formatter applied to the result: gofmt or gofumpt")
+	noReformat := flag.Bool("no-reformat", false, "Only insert the comments instead of formatting the whole file like gofmt")
+	wrap := flag.Int("wrap", 80, "Column at which generated comments are wrapped, 0 disables wrapping")
+	skipUnparseable := flag.Bool("skip-unparseable", true, "Skip files with syntax errors instead of counting them as failed")
+	strict := flag.Bool("strict", false, "Fail files for which the model returns comments whose position matches no declaration")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first file that fails instead of processing the remaining files")
+	patchPath := flag.String("patch", "", "Write a patch with the changes of all files to the given file instead of writing the files")
+	outputDir := flag.String("output-dir", "", "Write the commented copies of the files to this directory instead of overwriting them")
+	statePath := flag.String("state", "", "Record the processed files in this JSON file and skip them on later runs while unchanged")
+	force := flag.Bool("force", false, "With -state, process all files again even if they are unchanged")
+	backup := flag.Bool("backup", false, "Write the original contents to <file>.bak before overwriting")
+	provider := flag.String("provider", providerMoonshot, "API provider: moonshot, or local for an OpenAI-compatible server such as Ollama")
+	baseURL := flag.String("base-url", "", "Base URL of the API (default from MOONSHOT_BASE_URL)")
+	model := flag.String("model", "moonshot-v1-8k", "Model used to generate comments")
+	var fallbackModels stringSlice
+	flag.Var(&fallbackModels, "fallback-model", "Model to use when the previous one is overloaded, can be repeated")
+	temperature := flag.Float64("temperature", 0.3, "Sampling temperature of the model")
+	deterministic := flag.Bool("deterministic", false, "Use the smallest positive temperature and a fixed seed for reproducible output, where the provider supports it")
+	promptFile := flag.String("prompt-file", "", "Custom prompt template file, {{.Code}} is replaced with the code")
+	systemPromptFile := flag.String("system-prompt-file", "", "Custom system prompt template file replacing the built-in instructions")
+	noSystemPrompt := flag.Bool("no-system-prompt", false, "Send the instructions and the code in a single user message")
+	noCache := flag.Bool("no-cache", false, "Disable the response cache")
+	clearCache := flag.Bool("clear-cache", false, "Remove all cached responses")
+	stream := flag.Bool("stream", false, "Use the streaming API and show the bytes received while waiting")
+	progressFormat := flag.String("progress", progressText, "Progress format: text, or json for a line of JSON on stdout per finished file")
+	structured := flag.Bool("structured", false, "Have the model return the comments through a tool call with a JSON schema instead of plain text")
+	list := flag.Bool("list", false, "Print the files that would be processed and exit without calling the model")
+	check := flag.Bool("check", false, "Report exported declarations without doc comments and exit non-zero if any, without calling the model")
+	price := flag.Float64("price", 0, "Price in USD per 1K tokens, used to estimate the cost of a run")
+	statsPath := flag.String("stats", "", "Write a JSON report of the run with the status, comments, tokens, latency and model of each file to this file")
+	configPath := flag.String("config", "", "Config file with flag defaults (default \".gocmt.yaml\" if present)")
+	envFile := flag.String("env-file", "", "File with environment variables such as MOONSHOT_API_KEY (default \".env\" if present)")
+	logPath := flag.String("log", "logfile.log", "Log file path, empty or \"off\" disables file logging")
+	verbose := flag.Bool("v", false, "Verbose output, echo the log lines to stderr")
+	quiet := flag.Bool("q", false, "Quiet output, only print errors and the final summary")
+	noColor := flag.Bool("no-color", false, "Disable colored output, also disabled by the NO_COLOR environment variable")
+	versionFlag := flag.Bool("version", false, "Print the version, git commit and build date and exit")
 	helpFlag := flag.Bool("h", false, "Show this help message and exit")
 
 	flag.Parse()
@@ -90,414 +390,939 @@ func main() {
 		printHelp()
 		return
 	}
+	if *versionFlag || (flag.NArg() == 1 && flag.Arg(0) == "version") {
+		fmt.Println(versionString())
+		return
+	}
 
-	if *commitFlag != "" && *fileOrDir != "" {
-		fmt.Printf("× Error: -f and -c cannot be specified at same time.\n\n")
+	if *verbose && *quiet {
+		logger.Errorf("× Error: -v and -q cannot be specified at same time.\n\n")
 		printHelp()
 		return
 	}
+	if *verbose {
+		logger.verbosity = verbosityVerbose
+	} else if *quiet {
+		logger.verbosity = verbosityQuiet
+	}
+
+	if err := loadEnvFile(*envFile); err != nil {
+		logger.Errorf("× Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Errorf("× Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := applyConfig(flag.CommandLine, cfg); err != nil {
+		logger.Errorf("× Error: %v\n", err)
+		os.Exit(1)
+	}
+	logger.color = !*noColor && !noColorEnv()
+
+	// Setting up logger
+	closeLog := logger.setupLogFile(*logPath)
+	defer closeLog()
+
+	var cache *responseCache
+	if !*noCache || *clearCache {
+		cache, err = newResponseCache()
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *clearCache {
+		if err := cache.clear(); err != nil {
+			logger.Errorf("× Error: failed to clear cache: %v\n", err)
+			os.Exit(1)
+		}
+		logger.Printf("✔ Cleared cache %s\n", cache.dir)
+		if *commitFlag == "" && *since == "" && *fromFile == "" && *base == "" && len(pkgPatterns) == 0 && len(fileOrDir) == 0 {
+			return
+		}
+	}
+	if *noCache {
+		cache = nil
+	}
+
+	if *staged {
+		if *commitFlag != "" && *commitFlag != stagedRef {
+			logger.Errorf("× Error: -staged and -c cannot be specified at same time.\n\n")
+			printHelp()
+			return
+		}
+		*commitFlag = stagedRef
+	}
 
-	if *commitFlag == "" && *fileOrDir == "" {
-		fmt.Printf("× Error: please provide a file or directory containing Go code using -f or -c flag.\n\n")
+	if *head != "" && *base == "" {
+		logger.Errorf("× Error: -head requires -base.\n\n")
 		printHelp()
 		return
 	}
+	if *base != "" {
+		if *commitFlag != "" {
+			logger.Errorf("× Error: -base cannot be specified together with -c or -staged.\n\n")
+			printHelp()
+			return
+		}
+		headRef := *head
+		if headRef == "" {
+			headRef = "HEAD"
+		}
+		*commitFlag = *base + "..." + headRef
+	}
+
+	if *commitFlag != "" && len(fileOrDir) > 0 {
+		logger.Errorf("× Error: -f and -c cannot be specified at same time.\n\n")
+		printHelp()
+		return
+	}
+
+	if *since != "" && (*commitFlag != "" || len(fileOrDir) > 0) {
+		logger.Errorf("× Error: -since cannot be specified together with -f or -c.\n\n")
+		printHelp()
+		return
+	}
+
+	if *summary && !*dryRun {
+		logger.Errorf("× Error: -summary requires -dry-run.\n\n")
+		printHelp()
+		return
+	}
+
+	if *changedOnly && *commitFlag == "" {
+		logger.Errorf("× Error: -changed-only requires -c, -staged or -base.\n\n")
+		printHelp()
+		return
+	}
+
+	if *fromFile != "" && (*commitFlag != "" || *since != "" || len(fileOrDir) > 0) {
+		logger.Errorf("× Error: -from-file cannot be specified together with -f, -c or -since.\n\n")
+		printHelp()
+		return
+	}
+
+	if len(pkgPatterns) > 0 && (*commitFlag != "" || *since != "" || *fromFile != "" || len(fileOrDir) > 0) {
+		logger.Errorf("× Error: -pkg cannot be specified together with -f, -c, -since or -from-file.\n\n")
+		printHelp()
+		return
+	}
+
+	if *commitFlag == "" && *since == "" && *fromFile == "" && len(pkgPatterns) == 0 && len(fileOrDir) == 0 {
+		logger.Errorf("× Error: please provide a file or directory containing Go code using -f or -c flag.\n\n")
+		printHelp()
+		return
+	}
+
+	if err := gocmt.ValidateLanguage(*lang); err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+
+	if *wrap < 0 {
+		logger.Errorf("× Error: -wrap must not be negative.\n\n")
+		printHelp()
+		return
+	}
+
+	if *interactive && *dryRun {
+		logger.Errorf("× Error: -interactive and -dry-run cannot be specified at same time.\n\n")
+		printHelp()
+		return
+	}
+	if *patchPath != "" && len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		logger.Errorf("× Error: -patch cannot be used with -f -, use -dry-run instead.\n\n")
+		printHelp()
+		return
+	}
+	if *outputDir != "" && len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		logger.Errorf("× Error: -output-dir cannot be used with -f -.\n\n")
+		printHelp()
+		return
+	}
+	if *outputDir != "" && (*dryRun || *patchPath != "" || *backup) {
+		logger.Errorf("× Error: -output-dir cannot be used with -dry-run, -patch or -backup.\n\n")
+		printHelp()
+		return
+	}
+	if *statePath != "" && (*dryRun || *patchPath != "" || *outputDir != "" || (len(fileOrDir) == 1 && fileOrDir[0] == "-")) {
+		logger.Errorf("× Error: -state records the files written in place and cannot be used with -dry-run, -patch, -output-dir or -f -.\n\n")
+		printHelp()
+		return
+	}
+	if *statsPath != "" && len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		logger.Errorf("× Error: -stats reports on files and cannot be used with -f -.\n\n")
+		printHelp()
+		return
+	}
+	if *list && len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		logger.Errorf("× Error: -list cannot be used with -f -.\n\n")
+		printHelp()
+		return
+	}
+	if *interactive && len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		logger.Errorf("× Error: -interactive needs stdin for the answers and cannot be used with -f -.\n\n")
+		printHelp()
+		return
+	}
+	if *interactive && *fromFile == "-" {
+		logger.Errorf("× Error: -interactive needs stdin for the answers and cannot be used with -from-file -.\n\n")
+		printHelp()
+		return
+	}
+
+	if err := validateProgress(*progressFormat); err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+	if *progressFormat == progressJSON && *dryRun {
+		logger.Errorf("× Error: -progress json and -dry-run both write to stdout, use -patch instead.\n\n")
+		printHelp()
+		return
+	}
+	if *progressFormat == progressJSON {
+		// Keep stdout for the JSON lines.
+		logger.console = os.Stderr
+	}
+
+	if *rpm < 0 {
+		logger.Errorf("× Error: -rpm must not be negative.\n\n")
+		printHelp()
+		return
+	}
+
+	if *maxComments < 0 {
+		logger.Errorf("× Error: -max-comments must not be negative.\n\n")
+		printHelp()
+		return
+	}
+	if *maxFileSize < 0 {
+		logger.Errorf("× Error: -max-file-size must not be negative.\n\n")
+		printHelp()
+		return
+	}
+
+	if *concurrency < 1 {
+		logger.Errorf("× Error: -n must be at least 1.\n\n")
+		printHelp()
+		return
+	}
+	if *provider != providerMoonshot && *provider != providerLocal {
+		logger.Errorf("× Error: invalid -provider %q, must be one of: %s, %s.\n\n", *provider, providerMoonshot, providerLocal)
+		printHelp()
+		return
+	}
+	if *provider == providerLocal {
+		// The default model only exists on Moonshot.
+		modelSet := false
+		flag.Visit(func(f *flag.Flag) {
+			modelSet = modelSet || f.Name == "model"
+		})
+		if !modelSet {
+			logger.Errorf("× Error: -provider local requires -model.\n\n")
+			printHelp()
+			return
+		}
+	}
+	if *concurrencyPerHost < 0 {
+		logger.Errorf("× Error: -concurrency-per-host must not be negative.\n\n")
+		printHelp()
+		return
+	}
+
+	scope, err := gocmt.ParseScope(*scopeFlag)
+	if err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+
+	format, err := newFormatter(*formatterFlag)
+	if err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+	if format != nil && *noReformat {
+		logger.Errorf("× Error: -formatter and -no-reformat cannot be specified at same time.\n\n")
+		printHelp()
+		return
+	}
+
+	style, err := gocmt.ParseCommentStyle(*styleFlag)
+	if err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+
+	var match *regexp.Regexp
+	if *matchFlag != "" {
+		match, err = regexp.Compile(*matchFlag)
+		if err != nil {
+			logger.Errorf("× Error: invalid -match regular expression: %v\n\n", err)
+			printHelp()
+			return
+		}
+	}
+
+	var promptTmpl *template.Template
+	if *promptFile != "" {
+		promptTmpl, err = gocmt.LoadPromptTemplate(*promptFile)
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var systemPromptTmpl *template.Template
+	if *systemPromptFile != "" {
+		systemPromptTmpl, err = gocmt.LoadSystemPromptTemplate(*systemPromptFile)
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(fallbackModels) == 0 {
+		fallbackModels = cfg.FallbackModels
+	}
+	opts := gocmt.Options{
+		Model:             *model,
+		FallbackModels:    fallbackModels,
+		Temperature:       float32(*temperature),
+		Deterministic:     *deterministic,
+		Language:          *lang,
+		PromptTemplate:    promptTmpl,
+		NoSystemPrompt:    *noSystemPrompt,
+		Timeout:           *timeout,
+		RequestsPerMinute: *rpm,
+		Stream:            *stream,
+		Structured:        *structured,
+		Logger:            logger,
+		Format:            format,
+		NoReformat:        *noReformat,
+		Wrap:              *wrap,
+		Style:             style,
+		GodocStyle:        *godocStyle,
+		MaxComments:       *maxComments,
+		Overwrite:         *overwrite,
+		Fields:            *fields,
+		KeepImports:       *keepImports,
+		KeepBodies:        *keepBodies,
+		Explain:           *explain,
+		Scope:             scope,
+		Match:             match,
+	}
+	opts.SystemPromptTemplate = systemPromptTmpl
+	// A nil *responseCache must not end up in the interface.
+	if cache != nil {
+		opts.Cache = cache
+	}
+	if *interactive {
+		// One prompt at a time.
+		*concurrency = 1
+		opts.Approve = newReviewer(os.Stdin).approve
+	}
+	header, err := parseHeaders(cfg.Headers, headerFlag)
+	if err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+	if *baseURL == "" {
+		*baseURL = cfg.BaseURL
+	}
+	ccfg := clientConfig{
+		provider:        *provider,
+		baseURL:         *baseURL,
+		proxy:           *proxy,
+		timeout:         *timeout,
+		header:          header,
+		idleConns:       *concurrency,
+		maxConnsPerHost: *concurrencyPerHost,
+	}
+
+	// Cancel in-flight requests and stop launching new work on Ctrl-C or
+	// SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Read Go code from stdin and write the result to stdout
+	if len(fileOrDir) == 1 && fileOrDir[0] == "-" {
+		if *check {
+			if !checkStdin(os.Stdin) {
+				os.Exit(1)
+			}
+			return
+		}
+		// Keep stdout clean for the resulting code.
+		logger.console = os.Stderr
+		gen, err := newGenerator(opts, ccfg)
+		if err == nil {
+			err = processStdin(ctx, gen, *dryRun, *summary, *strict)
+			printUsage(gen, *price)
+		}
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	excludes, err := compileGlobs(excludeFlag)
+	if err != nil {
+		logger.Errorf("× Error: %v\n\n", err)
+		printHelp()
+		return
+	}
+	fopts := fileOptions{
+		excludes:         excludes,
+		includeGenerated: *includeGenerated,
+		includeTests:     *includeTests,
+		followSymlinks:   *followSymlinks,
+		gitignore:        !*noGitignore,
+		maxFileSize:      *maxFileSize,
+	}
+	// Build constraints are only checked when asked for, so that files for
+	// other platforms get comments too by default.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tags" {
+			fopts.build = buildContext(*tags)
+		}
+	})
 
 	var goFiles []string
+	var skippedFiles int
 	var fileOrDirList []string
-	if *fileOrDir != "" {
-		fileOrDirList = []string{*fileOrDir}
+	if len(fileOrDir) > 0 {
+		fileOrDirList = fileOrDir
 	} else if *commitFlag != "" {
 		fileOrDirList, err = gitDiff(*commitFlag)
 		if err != nil {
-			fmt.Printf("× Error: get change files by -c %s as %v\n", *commitFlag, err)
+			logger.Errorf("× Error: get change files by -c %s as %v\n", *commitFlag, err)
+			return
+		}
+	} else if *since != "" {
+		fileOrDirList, err = gitSince(*since)
+		if err != nil {
+			logger.Errorf("× Error: get change files by -since %s as %v\n", *since, err)
+			return
+		}
+	} else if *fromFile != "" {
+		fileOrDirList, err = readFileList(*fromFile)
+		if err != nil {
+			logger.Errorf("× Error: read file list from %s as %v\n", *fromFile, err)
+			return
+		}
+	} else if len(pkgPatterns) > 0 {
+		fileOrDirList, err = goList(pkgPatterns, *tags, *includeTests)
+		if err != nil {
+			logger.Errorf("× Error: list packages %s as %v\n", strings.Join(pkgPatterns, " "), err)
 			return
 		}
 	}
-	goFiles, err = getGoFiles(fileOrDirList)
+	goFiles, skippedFiles, err = getGoFiles(fileOrDirList, fopts)
 	if err != nil {
-		fmt.Printf("× Error: get go files as %v\n", err)
+		logger.Errorf("× Error: get go files as %v\n", err)
+		return
+	}
+
+	// Files processed before and unchanged since are skipped before
+	// anything is sent to the model.
+	var state *manifest
+	var unchangedFiles int
+	if *statePath != "" {
+		state, err = loadManifest(*statePath)
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			return
+		}
+		if !*force {
+			goFiles, unchangedFiles = state.pending(goFiles)
+			skippedFiles += unchangedFiles
+		}
+	}
+	if *list {
+		// Only the paths go to stdout, for use in scripts.
+		for _, file := range goFiles {
+			fmt.Println(file)
+		}
 		return
 	}
-	if len(goFiles) == 0 {
-		fmt.Println("Hint: no go files found for processing.")
+	if len(goFiles) == 0 && unchangedFiles > 0 {
+		logger.Printf("Hint: no go files changed since they were processed (%d unchanged), use -force to process them again.\n", unchangedFiles)
+		return
+	} else if len(goFiles) == 0 {
+		logger.Printf("Hint: no go files found for processing.\n")
 		return
 	} else {
-		fmt.Printf("» Comments will be added to these go files soon:\n%s\n\n", strings.Join(goFiles, "\n"))
+		if !*check {
+			logger.Infof("» Comments will be added to these go files soon:\n%s\n\n", strings.Join(goFiles, "\n"))
+		}
+	}
+
+	if *check {
+		if !checkFiles(goFiles) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The changed lines are looked up once for all files.
+	var changedLines map[string][]gocmt.LineRange
+	if *changedOnly {
+		changedLines, err = gitChangedLines(*commitFlag)
+		if err != nil {
+			logger.Errorf("× Error: get changed lines by -c %s as %v\n", *commitFlag, err)
+			os.Exit(1)
+		}
+	}
+
+	// One file of each package without a package comment gets one; when
+	// commenting changed lines only, no package comment is added.
+	var packageFiles map[string]bool
+	if *packageComment && changedLines == nil {
+		packageFiles = gocmt.PackageCommentFiles(goFiles)
+		for file := range packageFiles {
+			logger.Debugf("Adding a package comment to %s", file)
+		}
+	}
+
+	// Work out where each file goes up front, so that a file that can't be
+	// placed fails the run before any request is made.
+	var outputPaths map[string]string
+	if *outputDir != "" {
+		outputPaths, err = mapOutputPaths(*outputDir, fileOrDir, goFiles)
+		if err != nil {
+			logger.Errorf("× Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// Create MoonShot API client
-	token := os.Getenv("MOONSHOT_API_KEY")
-	if token == "" {
-		fmt.Println("× Error: the environment variable MOONSHOT_API_KEY is not set.")
+	client, err := newClientFromEnv(ccfg)
+	if err != nil {
+		logger.Errorf("× Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Check the credentials once instead of failing every file with the
+	// same error.
+	if err := preflight(ctx, client, ccfg); err != nil {
+		logger.Errorf("× Error: %v\n", err)
 		os.Exit(1)
 	}
-	baseURL := os.Getenv("MOONSHOT_BASE_URL")
-	client := NewMoonShotClient(baseURL, token)
+	opts.Client = client
+	gen, err := gocmt.NewCommentGenerator(opts)
+	if err != nil {
+		logger.Errorf("× Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The patch collects the changes of all files instead of writing them.
+	var patch *os.File
+	if *patchPath != "" {
+		patch, err = os.Create(*patchPath)
+		if err != nil {
+			logger.Errorf("× Error: failed to create patch file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var runStats *stats
+	if *statsPath != "" {
+		runStats = newStats(*statsPath)
+	}
 
 	// Process each Go file
 	total := len(goFiles)
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, *concurrency)
-	done := make(chan bool)
-	progress := make(chan int)
-	var completed int32
+	done := make(chan struct{})
+	progress := make(chan progressEvent)
+	var diffMu sync.Mutex
+	// commented, failed and skipped count the files by outcome; skipped
+	// starts with the files excluded while collecting them.
+	var commented, failed int32
+	skipped := int32(skippedFiles)
+	// added counts the comments added across all files, for -summary.
+	var added int32
+
+	// runCtx is cancelled by -fail-fast on the first failure, in addition
+	// to the signals cancelling ctx.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
 
+	// The progress aggregator is the only reader of progress and owns the
+	// completed counter. It drains the channel until it is closed, which
+	// happens only after every worker has reported, so no send can block
+	// forever or hit a closed channel.
+	// The text progress is a bar updated in place on a terminal, and a line
+	// per file otherwise.
+	start := time.Now()
+	bar := isTerminal(logger.console)
+	if *progressFormat == progressText && bar {
+		logger.setStatus(progressLine(0, total, 0, bar))
+	}
 	go func() {
-		for range progress {
-			atomic.AddInt32(&completed, 1)
-			var percent float64
-			if int(completed) >= total {
-				percent = 100.0
-			} else if int(completed) == 0 {
-				percent = 0.0
-			} else {
-				percent = float64(completed) / float64(total) * 100
-			}
-			fmt.Printf("\rProgress: %d/%d, %.2f%%\n", completed, total, percent)
-			if int(completed) >= total {
-				fmt.Println("\nAll files processed.")
-				done <- true
-				break
+		defer close(done)
+		completed := 0
+		for ev := range progress {
+			completed++
+			if *progressFormat == progressJSON {
+				ev.Completed, ev.Total = completed, total
+				if err := writeProgressJSON(os.Stdout, ev); err != nil {
+					logger.Debugf("Failed to write progress: %v", err)
+				}
+				continue
 			}
+			logger.setStatus(progressLine(completed, total, time.Since(start), bar))
 		}
+		logger.endStatus()
 	}()
 
-	for i, file := range goFiles {
+	for _, file := range goFiles {
+		// Stop picking up new files once interrupted or failed fast.
+		select {
+		case sem <- struct{}{}:
+		case <-runCtx.Done():
+		}
+		if runCtx.Err() != nil {
+			break
+		}
 		wg.Add(1)
-		sem <- struct{}{}
 
-		go func(i int, file string) {
+		go func(file string) {
 			var (
-				err           error
-				goCodeByte    []byte
-				processedCode string
-				resp          openai.ChatCompletionResponse
-				result        string
-				formatResult  string
+				err          error
+				unchanged    bool
+				fileInfo     os.FileInfo
+				goCodeByte   []byte
+				formatResult string
+				result       gocmt.AddResult
 			)
+			fileStart := time.Now()
 			defer func() {
-				if err != nil {
-					fmt.Printf("× Error: %v, File: %s\n", err, file)
+				ev := progressEvent{File: file, Status: statusDone}
+				if err != nil && runCtx.Err() != nil {
+					// The run was stopped while this file was in flight,
+					// its error is just the cancellation.
+					logger.Debugf("Cancelled processing %s: %v", file, err)
+					ev.Status = statusCancelled
+				} else if err != nil {
+					atomic.AddInt32(&failed, 1)
+					logger.Errorf("× Error: %v, File: %s\n", err, file)
+					if *failFast {
+						cancelRun()
+					}
+					ev.Status, ev.Error = statusFailed, err.Error()
+				} else if unchanged {
+					atomic.AddInt32(&skipped, 1)
+					ev.Status = statusSkipped
+				} else {
+					atomic.AddInt32(&commented, 1)
+				}
+				if runStats != nil {
+					fs := fileStats{
+						File:             filepath.ToSlash(file),
+						Status:           ev.Status,
+						Error:            ev.Error,
+						PromptTokens:     result.PromptTokens,
+						CompletionTokens: result.CompletionTokens,
+						LatencyMS:        time.Since(fileStart).Milliseconds(),
+						Model:            result.Model,
+					}
+					if ev.Status == statusDone {
+						fs.Comments = len(result.Applied)
+					}
+					runStats.record(fs)
 				}
 				<-sem
+				progress <- ev
 				wg.Done()
-				progress <- i
 			}()
-			log.Printf("Processing file: %s", file)
-			fmt.Printf("» Processing %s...\n", file)
+			logger.Debugf("Processing file: %s", file)
+			logger.Infof("» Processing %s...\n", file)
 
-			// Read Go code from file
-			goCodeByte, err = os.ReadFile(file)
+			// Keep the permission bits of the original file when writing
+			// it back or backing it up.
+			fileInfo, err = os.Stat(file)
 			if err != nil {
-				log.Printf("× Error reading file: %v", err)
+				logger.Debugf("× Error accessing file: %v", err)
 				return
 			}
-			goCode := string(goCodeByte)
+			perm := fileInfo.Mode().Perm()
 
-			// Format Go code
-			goCode, err = formatGoCode(goCode)
+			// Read Go code from file
+			goCodeByte, err = os.ReadFile(file)
 			if err != nil {
-				log.Printf("× Error format go code: %v", err)
+				logger.Debugf("× Error reading file: %v", err)
 				return
 			}
+			originalCode := string(goCodeByte)
 
-			// Process Go code
-			log.Printf("Go code before process:\n%s", goCode)
-			processedCode, err = processGoCode(goCode)
-			if err != nil {
-				log.Printf("× Error processing Go code: %v", err)
+			if changedLines != nil {
+				// A file without changed lines gets no comments, while
+				// nil lines would comment everything.
+				lines := changedLines[file]
+				if lines == nil {
+					lines = []gocmt.LineRange{}
+				}
+				result, err = gen.GenerateInLines(runCtx, originalCode, lines)
+			} else if packageFiles[file] {
+				result, err = gen.GenerateWithPackageComment(runCtx, originalCode)
+			} else {
+				result, err = gen.Generate(runCtx, originalCode)
+			}
+			formatResult = result.Code
+			var syntaxErr *gocmt.SyntaxError
+			if errors.As(err, &syntaxErr) && *skipUnparseable {
+				logger.Printf("Warning: skipping %s: %v\n", file, err)
+				err = nil
+				unchanged = true
 				return
 			}
-			log.Printf("Go code after process:\n%s", goCode)
-
-			// Perform API request and get comments
-			resp, err = client.CreateChatCompletion(
-				context.Background(),
-				openai.ChatCompletionRequest{
-					Model:       "moonshot-v1-8k",
-					Temperature: 0.3,
-					MaxTokens:   4096,
-					Messages: []openai.ChatCompletionMessage{
-						{
-							Role: openai.ChatMessageRoleUser,
-							Content: fmt.Sprintf(`### Role ###
-You are a Go language expert with a solid foundation in Go and high standards for code comments. Additionally, your English is excellent, enabling you to write professional English comments.
-### Requirements ###
-- Add meaningful and technical comments above each structure, method, function, and other key code.
-- Mark the code position and supplementary annotations in a structured manner, and output all the comments that need to be supplemented in JSON format
-- The return result is plain text, and three backticks are not needed.
-### Output Format Example ###
-{
-    "comments": [
-        {
-            "position": "type MockManagerInterface interface {",
-            "comment": "MockManagerInterface defines the interface for mock manager."
-        },
-        {
-            "position": "type mockManager struct {",
-            "comment": "mockManager is the implementation that mock manager."
-        }
-    ]
-}
-### Target Code ###
-%s`, processedCode),
-						},
-					},
-				},
-			)
 			if err != nil {
-				log.Printf("ChatCompletion error: %v", err)
 				return
 			}
-			commentsJSON := resp.Choices[0].Message.Content
-			log.Printf("ChatCompletion result:\n%s\n", commentsJSON)
-
-			// Process ChatCompletion result string
-			re := regexp.MustCompile("(^```json\n)|(```$)")
-			commentsJSON = re.ReplaceAllString(commentsJSON, "")
-			commentsJSON = strings.TrimSpace(commentsJSON)
-
-			// Add the comments to the file.
-			result, err = addComments(goCode, commentsJSON)
-			if err != nil {
-				log.Printf("× Error adding comments to the file: %v", err)
+			if err = checkUnmatched(file, result.Unmatched, *strict); err != nil {
 				return
 			}
 
-			fmt.Printf("✔ Processed file %s\n", file)
+			logger.Infof("✔ Processed file %s\n", file)
 
-			formatResult, err = formatGoCode(result)
-			if err != nil {
-				log.Printf("× Error format go code: %v", err)
+			if outputPaths != nil {
+				// Copy files without new comments as well, so that the
+				// output directory holds the whole tree.
+				err = writeOutput(outputPaths[file], []byte(formatResult), perm)
+				if err != nil {
+					logger.Debugf("Failed to write Go code to output file: %v", err)
+				}
+				unchanged = formatResult == originalCode
 				return
 			}
 
-			err = os.WriteFile(file, []byte(formatResult), 0644)
-			if err != nil {
-				log.Printf("Failed to write Go code to file: %v", err)
+			// Leave files that are already documented untouched.
+			if formatResult == originalCode {
+				logger.Debugf("No comments to add to %s", file)
+				unchanged = true
+				if state != nil {
+					state.record(file, goCodeByte)
+				}
 				return
 			}
-		}(i, file)
-	}
 
-	go func() {
-		wg.Wait()
-		close(progress)
-	}()
-
-	<-done
-}
-
-func getGoFiles(fileOrDirList []string) ([]string, error) {
-	var goFiles []string
-	for _, f := range fileOrDirList {
-		// Check if the specified path is a directory or a file
-		fileInfo, err := os.Stat(f)
-		if err != nil {
-			log.Printf("× Error accessing file or directory: %v", err)
-			return nil, err
-		}
+			if *dryRun && *summary {
+				atomic.AddInt32(&added, int32(len(result.Applied)))
+				diffMu.Lock()
+				fmt.Printf("%s: +%d comments\n", filepath.ToSlash(file), len(result.Applied))
+				diffMu.Unlock()
+				return
+			}
+			if *dryRun {
+				// Print the diff as one block so that concurrent workers
+				// don't interleave their output.
+				diffMu.Lock()
+				fmt.Print(unifiedDiff(filepath.ToSlash(file), originalCode, formatResult))
+				diffMu.Unlock()
+				return
+			}
 
-		if fileInfo.IsDir() {
-			// If it's a directory, recursively find all Go files
-			err := filepath.Walk(f, func(path string, info os.FileInfo, err error) error {
+			if patch != nil {
+				// Diff against the code as read, before any changes.
+				diffMu.Lock()
+				_, err = patch.WriteString(unifiedDiff(filepath.ToSlash(file), originalCode, formatResult))
+				diffMu.Unlock()
 				if err != nil {
-					return err
+					err = fmt.Errorf("failed to write patch: %v", err)
 				}
-				if !info.IsDir() && strings.HasSuffix(info.Name(), ".go") && !strings.HasSuffix(info.Name(), "_test.go") {
-					goFiles = append(goFiles, path)
+				return
+			}
+
+			if *backup {
+				err = os.WriteFile(file+".bak", goCodeByte, perm)
+				if err != nil {
+					logger.Debugf("Failed to write backup file: %v", err)
+					err = fmt.Errorf("failed to write backup, file left unchanged: %v", err)
+					return
 				}
-				return nil
-			})
+			}
+
+			err = writeFileAtomic(file, []byte(formatResult), perm)
 			if err != nil {
-				log.Printf("× Error walking directory: %v", err)
-				return nil, err
+				logger.Debugf("Failed to write Go code to file: %v", err)
+				return
 			}
-		} else {
-			if strings.HasSuffix(fileInfo.Name(), ".go") && !strings.HasSuffix(fileInfo.Name(), "_test.go") {
-				goFiles = append(goFiles, f)
+			if state != nil {
+				state.record(file, []byte(formatResult))
 			}
-		}
+		}(file)
 	}
-	return goFiles, nil
-}
 
-func gitDiff(commitOrRef string) ([]string, error) {
-	files, err := gitCommand("diff", "--name-only", "--diff-filter=ACMR", commitOrRef)
-	if err != nil {
-		return nil, err
+	wg.Wait()
+	close(progress)
+	<-done
+	if patch != nil {
+		if err := patch.Close(); err != nil {
+			logger.Errorf("× Error: failed to write patch: %v\n", err)
+			os.Exit(1)
+		}
+		logger.Printf("✔ Wrote the changes to %s\n", *patchPath)
 	}
-	log.Printf("Changed files of %s:\n%s\n", commitOrRef, files)
-	files = strings.TrimSpace(files)
-	return strings.Split(files, "\n"), nil
-}
-
-func gitCommand(args ...string) (string, error) {
-	cmd := exec.Command("git", args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("failed to execute git command: %v", err)
+	// Save the state even if interrupted, so that the next run resumes.
+	if state != nil {
+		if err := state.save(); err != nil {
+			logger.Errorf("× Error: failed to write state file: %v\n", err)
+		}
 	}
-
-	return strings.TrimSpace(out.String()), nil
-}
-
-// addComments adds comments to the specified Go source file based on the JSON structure.
-func addComments(goCode string, commentsJSON string) (string, error) {
-	// Unmarshal the JSON string into a slice of Comment structs.
-	var comments CommentJSON
-	if err := json.Unmarshal([]byte(commentsJSON), &comments); err != nil {
-		return "", err
+	if runStats != nil {
+		promptTokens, completionTokens := gen.Usage()
+		totals := statsTotals{
+			Commented:        int(commented),
+			Failed:           int(failed),
+			Skipped:          int(skipped),
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			DurationMS:       time.Since(start).Milliseconds(),
+			Cost:             float64(promptTokens+completionTokens) / 1000 * *price,
+		}
+		if err := runStats.save(totals); err != nil {
+			logger.Errorf("× Error: failed to write stats: %v\n", err)
+		} else {
+			logger.Printf("✔ Wrote the stats to %s\n", *statsPath)
+		}
 	}
-	// Parse Go code into an AST (Abstract Syntax Tree).
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, "", goCode, parser.ParseComments)
-	if err != nil {
-		return "", fmt.Errorf("parsing Go code: %v", err)
-	}
-
-	// Create an ast.CommentMap from the ast.File's comments.
-	// This helps keeping the association between comments
-	// and AST nodes.
-	cmap := ast.NewCommentMap(fset, node, node.Comments)
-
-	// Traverse the AST to find comment positions and add comments.
-	ast.Inspect(node, func(n ast.Node) bool {
-		switch x := n.(type) {
-		case *ast.FuncDecl:
-			code := goCode[fset.Position(x.Pos()).Offset:fset.Position(x.End()).Offset]
-			addFunctionComments(cmap, code, x, comments.Comments)
-			// case *ast.TypeSpec:
-			// 	code := goCode[fset.Position(x.Pos()).Offset:fset.Position(x.End()).Offset]
-			// 	addTypeComments(cmap, code, x, comments.Comments)
-			// case *ast.GenDecl:
-			// 	code := goCode[fset.Position(x.Pos()).Offset:fset.Position(x.End()).Offset]
-			// 	addGeneralComments(cmap, code, x, comments.Comments)
-		}
-		return true
-	})
 
-	// Use the comment map to filter comments that don't belong anymore
-	// (the comments associated with the variable declaration), and create
-	// the new comments list.
-	node.Comments = cmap.Filter(node).Comments()
-
-	// Write the modified AST back to a string.
-	var buf bytes.Buffer
-	if err := format.Node(&buf, fset, node); err != nil {
-		return "", fmt.Errorf("formatting Go code: %v", err)
+	if *summary {
+		fmt.Printf("Total: +%d comments in %d files\n", added, commented)
+	}
+	logger.Printf("\nDone: %d commented, %d failed, %d skipped\n", commented, failed, skipped)
+	printUsage(gen, *price)
+	completed := commented + skipped - int32(skippedFiles)
+	if ctx.Err() != nil {
+		logger.Printf("× Interrupted, %d of %d files completed\n", completed, total)
+		os.Exit(130)
+	}
+	if failed > 0 && *failFast {
+		logger.Printf("× Stopped after the first failure, %d of %d files completed\n", completed, total)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		logger.Printf("× %d of %d files failed\n", failed, total)
+		os.Exit(1)
 	}
-	return buf.String(), nil
 }
 
-// addFunctionComments adds comments to function declarations based on position.
-func addFunctionComments(cmap ast.CommentMap, code string, decl *ast.FuncDecl, comments []Comment) {
-	for _, comment := range comments {
-		if strings.Contains(code, comment.Position) && decl.Doc == nil {
-			commentStr := strings.ReplaceAll(comment.Comment, "\n", "\n// ")
-			cmap[decl] = []*ast.CommentGroup{
-				{
-					List: []*ast.Comment{
-						{
-							Slash: decl.Pos() - 1,
-							Text:  "// " + commentStr,
-						},
-					},
-				},
-			}
-			break
+// checkFiles prints the exported declarations without doc comments in files
+// and reports whether all of them are documented.
+func checkFiles(files []string) bool {
+	var issues, failed int
+	for _, file := range files {
+		fileIssues, err := gocmt.CheckDocs(file)
+		if err != nil {
+			failed++
+			logger.Errorf("× Error: %v, File: %s\n", err, file)
+			continue
 		}
+		for _, issue := range fileIssues {
+			logger.Printf("%s\n", issue)
+		}
+		issues += len(fileIssues)
 	}
-}
 
-// addTypeComments adds comments to type declarations based on position.
-func addTypeComments(cmap ast.CommentMap, code string, decl *ast.TypeSpec, comments []Comment) {
-	for _, comment := range comments {
-		if strings.Contains(code, comment.Position) && decl.Doc == nil {
-			cmap[decl] = []*ast.CommentGroup{
-				{
-					List: []*ast.Comment{
-						{
-							Slash: decl.Name.NamePos - 6,
-							Text:  "// " + comment.Comment,
-						},
-					},
-				},
-			}
-			break
-		}
+	if issues > 0 {
+		logger.Printf("× %d exported declarations without doc comments in %d files\n", issues, len(files))
+	} else if failed == 0 {
+		logger.Printf("✔ All exported declarations in %d files have doc comments\n", len(files))
 	}
+	return issues == 0 && failed == 0
 }
 
-// addGeneralComments adds comments to general declarations (e.g., variables) based on position.
-func addGeneralComments(cmap ast.CommentMap, code string, decl *ast.GenDecl, comments []Comment) {
-	for _, spec := range decl.Specs {
-		switch x := spec.(type) {
-		case *ast.TypeSpec:
-			addTypeComments(cmap, code, x, comments)
-		}
+// checkStdin is checkFiles for the Go code read from r, the stdin of -f -.
+func checkStdin(r io.Reader) bool {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		logger.Errorf("× Error: failed to read stdin: %v\n", err)
+		return false
 	}
+	issues, err := gocmt.CheckDocsSource("<stdin>", src)
+	if err != nil {
+		logger.Errorf("× Error: %v, File: <stdin>\n", err)
+		return false
+	}
+	for _, issue := range issues {
+		logger.Printf("%s\n", issue)
+	}
+	if len(issues) > 0 {
+		logger.Printf("× %d exported declarations without doc comments in <stdin>\n", len(issues))
+		return false
+	}
+	logger.Printf("✔ All exported declarations in <stdin> have doc comments\n")
+	return true
 }
 
-func processGoCode(goCode string) (string, error) {
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, "", goCode, 0)
+// processStdin reads Go code from stdin, adds comments and writes the result
+// to stdout. Status messages go to stderr so that stdout only carries code.
+func processStdin(ctx context.Context, gen *gocmt.CommentGenerator, dryRun, summary, strict bool) error {
+	goCodeByte, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		return "", fmt.Errorf("parsing Go code: %w", err)
+		logger.Debugf("× Error reading stdin: %v", err)
+		return fmt.Errorf("failed to read stdin: %v", err)
 	}
+	originalCode := string(goCodeByte)
 
-	ast.Inspect(node, func(n ast.Node) bool {
-		switch x := n.(type) {
-		case *ast.FuncDecl:
-			if x.Body != nil {
-				replaceFuncBody(x)
-			}
-		}
-		return true
-	})
-
-	var buf bytes.Buffer
-	if err := format.Node(&buf, fset, node); err != nil {
-		return "", fmt.Errorf("formatting Go code: %w", err)
+	logger.Debugf("Processing file: <stdin>")
+	logger.Infof("» Processing <stdin>...\n")
+	result, err := gen.Generate(ctx, originalCode)
+	if err != nil {
+		return err
 	}
-	return removePackageAndImports(buf.String())
-}
-
-func removePackageAndImports(goCode string) (string, error) {
-	re := regexp.MustCompile(`(?s)package\s+\w+\s+import\s+\((.*?)\)`)
-	matches := re.FindStringSubmatch(goCode)
-	if len(matches) < 2 {
-		return "", fmt.Errorf("package or import section not found")
+	if err := checkUnmatched("<stdin>", result.Unmatched, strict); err != nil {
+		return err
 	}
+	logger.Infof("✔ Processed <stdin>\n")
 
-	cleanedCode := strings.ReplaceAll(goCode, matches[0], "")
-	return strings.TrimSpace(cleanedCode), nil
+	if dryRun && summary {
+		fmt.Printf("<stdin>: +%d comments\n", len(result.Applied))
+		return nil
+	}
+	if dryRun {
+		fmt.Print(unifiedDiff("stdin.go", originalCode, result.Code))
+		return nil
+	}
+	fmt.Print(result.Code)
+	return nil
 }
 
-func formatGoCode(goCode string) (string, error) {
-	// Format the provided Go code
-	formatted, err := format.Source([]byte(goCode))
-	if err != nil {
-		return "", fmt.Errorf("failed to format Go code: %v", err)
+// checkUnmatched warns about the comments the model returned for file whose
+// position matches no declaration, which are dropped. With strict the file
+// fails instead.
+func checkUnmatched(file string, unmatched []gocmt.Comment, strict bool) error {
+	var positions []string
+	for _, c := range unmatched {
+		positions = append(positions, fmt.Sprintf("%q", strings.TrimSpace(c.Position)))
+	}
+	if len(positions) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("%d comments match no declaration: %s", len(positions), strings.Join(positions, ", "))
 	}
-	return string(formatted), nil
+	logger.Printf("Warning: dropped %d comments for %s that match no declaration: %s\n", len(positions), file, strings.Join(positions, ", "))
+	return nil
 }
 
-func replaceFuncBody(decl *ast.FuncDecl) {
-	// Replace function body with empty string.
-	decl.Body = &ast.BlockStmt{
-		List: []ast.Stmt{
-			&ast.ExprStmt{
-				X: &ast.BasicLit{
-					Kind:  token.STRING,
-					Value: ``,
-				},
-			},
-		},
+// printUsage prints the total token usage of gen and, if pricePer1K is
+// positive, the estimated cost in USD.
+func printUsage(gen *gocmt.CommentGenerator, pricePer1K float64) {
+	prompt, completion := gen.Usage()
+	total := prompt + completion
+	logger.Printf("» Token usage: %d prompt + %d completion = %d tokens\n", prompt, completion, total)
+	if pricePer1K > 0 {
+		logger.Printf("» Estimated cost: $%.4f (at $%g per 1K tokens)\n", float64(total)/1000*pricePer1K, pricePer1K)
 	}
 }
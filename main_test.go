@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// captureConsole directs the console messages of the logger to a buffer for
+// the duration of the test.
+func captureConsole(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	console := logger.console
+	logger.console = &buf
+	t.Cleanup(func() { logger.console = console })
+	return &buf
+}
+
+func TestCheckStdin(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		ok   bool
+		want string
+	}{
+		{
+			name: "documented",
+			src:  "package p\n\n// F does nothing.\nfunc F() {}\n",
+			ok:   true,
+			want: "✔ All exported declarations in <stdin> have doc comments\n",
+		},
+		{
+			name: "missing comment",
+			src:  "package p\n\nfunc F() {}\n",
+			want: "<stdin>:3:1: exported function F should have comment\n× 1 exported declarations without doc comments in <stdin>\n",
+		},
+		{
+			name: "syntax error",
+			src:  "package p\n\nfunc F( {}\n",
+			want: "× Error:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureConsole(t)
+			if ok := checkStdin(strings.NewReader(tt.src)); ok != tt.ok {
+				t.Errorf("checkStdin() = %v, want %v", ok, tt.ok)
+			}
+			if !strings.HasPrefix(buf.String(), tt.want) {
+				t.Errorf("checkStdin() printed %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// manifest records the content hash of each file gocmt has processed, for
+// -state, so that later runs skip the files that haven't changed since
+// without calling the model. Unlike the response cache it lives next to the
+// code and is keyed by file.
+type manifest struct {
+	path string
+	// dir is the absolute directory of the manifest, which the paths of the
+	// files are stored relative to.
+	dir string
+
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// manifestFile is the on-disk format of a manifest.
+type manifestFile struct {
+	// Files maps the slash-separated file paths to the SHA-256 hashes of
+	// their contents.
+	Files map[string]string `json:"files"`
+}
+
+// loadManifest reads the manifest at path. A missing file results in an
+// empty manifest, which is created when saved.
+func loadManifest(path string) (*manifest, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{path: path, dir: filepath.Dir(abs), files: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	var mf manifestFile
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	for file, hash := range mf.Files {
+		m.files[file] = hash
+	}
+	return m, nil
+}
+
+// key returns the path file is stored under, relative to the manifest's
+// directory if possible.
+func (m *manifest) key(file string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+	if rel, err := filepath.Rel(m.dir, abs); err == nil && localPath(rel) {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(abs)
+}
+
+// contentHash returns the hex-encoded SHA-256 hash of data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pending returns the files that aren't recorded with their current
+// contents, and the number of files left out because they are.
+func (m *manifest) pending(files []string) ([]string, int) {
+	var pending []string
+	var unchanged int
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil && m.processed(file, data) {
+			logger.Debugf("Skipping %s, unchanged since it was processed", file)
+			unchanged++
+			continue
+		}
+		pending = append(pending, file)
+	}
+	return pending, unchanged
+}
+
+// processed reports whether file is recorded with the contents data.
+func (m *manifest) processed(file string, data []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, ok := m.files[m.key(file)]
+	return ok && hash == contentHash(data)
+}
+
+// record records file as processed with the contents data, as written by
+// gocmt. It is safe to call from concurrent workers.
+func (m *manifest) record(file string, data []byte) {
+	key := m.key(file)
+	hash := contentHash(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[key] = hash
+}
+
+// save writes the manifest back to its file.
+func (m *manifest) save() error {
+	m.mu.Lock()
+	data, err := json.MarshalIndent(manifestFile{Files: m.files}, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,91 @@
+package gocmt
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// DocIssue describes an exported declaration that lacks a doc comment.
+type DocIssue struct {
+	Pos token.Position
+	// Kind is the kind of declaration, e.g. "function" or "method".
+	Kind string
+	// Name is the declared name, qualified with the receiver for methods.
+	Name string
+}
+
+// String formats the issue like a compiler diagnostic.
+func (i DocIssue) String() string {
+	return fmt.Sprintf("%s: exported %s %s should have comment", i.Pos, i.Kind, i.Name)
+}
+
+// CheckDocs parses the Go file and returns the exported functions, methods,
+// types, variables and constants that have no doc comment.
+func CheckDocs(file string) ([]DocIssue, error) {
+	return checkDocs(file, nil)
+}
+
+// CheckDocsSource is like CheckDocs, but checks the Go source src, such as
+// code read from stdin. The positions of the issues refer to filename.
+func CheckDocsSource(filename string, src []byte) ([]DocIssue, error) {
+	return checkDocs(filename, src)
+}
+
+// checkDocs implements CheckDocs, reading the file if src is nil.
+func checkDocs(filename string, src interface{}) ([]DocIssue, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Go code: %v", err)
+	}
+
+	var issues []DocIssue
+	for _, decl := range node.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if documented(d.Doc) || !ast.IsExported(d.Name.Name) {
+				continue
+			}
+			kind, name := "function", d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				recv := receiverTypeName(d.Recv.List[0].Type)
+				if !ast.IsExported(recv) {
+					continue
+				}
+				kind, name = "method", recv+"."+name
+			}
+			issues = append(issues, DocIssue{Pos: fset.Position(d.Pos()), Kind: kind, Name: name})
+		case *ast.GenDecl:
+			// A doc comment on the declaration covers all of its specs,
+			// e.g. a commented const block.
+			if documented(d.Doc) {
+				continue
+			}
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if !documented(s.Doc) && ast.IsExported(s.Name.Name) {
+						issues = append(issues, DocIssue{Pos: fset.Position(s.Pos()), Kind: "type", Name: s.Name.Name})
+					}
+				case *ast.ValueSpec:
+					if documented(s.Doc) {
+						continue
+					}
+					kind := "var"
+					if d.Tok == token.CONST {
+						kind = "const"
+					}
+					for _, ident := range s.Names {
+						if ast.IsExported(ident.Name) {
+							issues = append(issues, DocIssue{Pos: fset.Position(ident.Pos()), Kind: kind, Name: ident.Name})
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+	return issues, nil
+}
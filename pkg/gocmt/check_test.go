@@ -0,0 +1,53 @@
+package gocmt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDocsSource(t *testing.T) {
+	src := `package p
+
+// Documented is documented.
+func Documented() {}
+
+func Missing() {}
+
+func unexported() {}
+
+type T struct{}
+
+func (T) M() {}
+
+// Consts are documented as a group.
+const (
+	A = 1
+	B = 2
+)
+
+var V, w int
+`
+	issues, err := CheckDocsSource("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.String())
+	}
+	want := []string{
+		"p.go:6:1: exported function Missing should have comment",
+		"p.go:10:6: exported type T should have comment",
+		"p.go:12:1: exported method T.M should have comment",
+		"p.go:20:5: exported var V should have comment",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckDocsSource() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestCheckDocsSourceSyntaxError(t *testing.T) {
+	if _, err := CheckDocsSource("p.go", []byte("package p\n\nfunc (")); err == nil {
+		t.Fatal("CheckDocsSource() succeeded on invalid code")
+	}
+}
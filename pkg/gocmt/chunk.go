@@ -0,0 +1,38 @@
+package gocmt
+
+import "strings"
+
+// maxChunkTokens is the estimated number of code tokens sent in a single
+// request. It leaves room in the 8k context for the prompt and the 4096
+// tokens reserved for the response.
+const maxChunkTokens = 3000
+
+// estimateTokens roughly estimates the number of tokens in s, assuming four
+// characters per token.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// chunkDecls groups processed top-level declarations into chunks whose
+// estimated token count stays below maxTokens. A declaration that exceeds
+// maxTokens on its own is put in a chunk by itself.
+func chunkDecls(decls []string, maxTokens int) []string {
+	var (
+		chunks  []string
+		current []string
+		tokens  int
+	)
+	for _, decl := range decls {
+		t := estimateTokens(decl)
+		if len(current) > 0 && tokens+t > maxTokens {
+			chunks = append(chunks, strings.Join(current, "\n\n"))
+			current, tokens = nil, 0
+		}
+		current = append(current, decl)
+		tokens += t
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, "\n\n"))
+	}
+	return chunks
+}
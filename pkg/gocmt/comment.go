@@ -0,0 +1,1019 @@
+package gocmt
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CommentJSON is the JSON object the model responds with.
+type CommentJSON struct {
+	Comments []Comment `json:"comments"`
+}
+
+// Comment represents the structure of a comment in the JSON.
+type Comment struct {
+	Position string `json:"position"`
+	Comment  string `json:"comment"`
+}
+
+// AppliedComment describes a doc comment added to a declaration.
+type AppliedComment struct {
+	// Name is the declaration name, qualified with the receiver type for
+	// methods, e.g. "Server.Start".
+	Name string
+	// Line is the line of the declaration in the source passed to
+	// AddComments.
+	Line int
+	// Text is the comment text without the comment markers.
+	Text string
+}
+
+// Proposal is a comment about to be added to a declaration, passed to
+// Options.Approve.
+type Proposal struct {
+	// Name is the declaration name, qualified with the receiver type for
+	// methods.
+	Name string
+	// Code is the signature of a function or method, or the declaration of
+	// a type.
+	Code string
+	// Text is the proposed comment text.
+	Text string
+}
+
+// AddResult describes the outcome of AddComments.
+type AddResult struct {
+	// Code is the source with the comments added.
+	Code string
+	// Applied lists the comments added, in source order.
+	Applied []AppliedComment
+	// Unmatched lists the comments whose position didn't match any
+	// declaration.
+	Unmatched []Comment
+	// Model is the model that generated the comments, a fallback model if
+	// any request fell back, and empty if there was nothing to request.
+	Model string
+	// PromptTokens and CompletionTokens are the tokens the API reported for
+	// the requests; cached and streamed responses report none.
+	PromptTokens, CompletionTokens int64
+}
+
+// AddComments adds the given comments to the Go source goCode. Comments are
+// matched to declarations by their position; the result lists the comments
+// applied and those that matched nothing. The package clause gets a comment
+// only with Options.PackageComment, and an existing package comment is never
+// replaced.
+func AddComments(goCode string, comments []Comment, opts Options) (AddResult, error) {
+	opts, err := opts.withLineDecls(goCode)
+	if err != nil {
+		return AddResult{}, err
+	}
+	if opts.MaxComments > 0 {
+		opts, err = limitComments(goCode, comments, opts)
+		if err != nil {
+			return AddResult{}, err
+		}
+	}
+	if opts.Style == StyleBlock {
+		return addBlockComments(goCode, comments, opts)
+	}
+	result, crowded, err := addComments(goCode, comments, opts)
+	if err != nil || len(crowded) == 0 {
+		return result, err
+	}
+
+	// Separate the crowded declarations from the code above them with a
+	// blank line, so that their doc comments are printed in place, and
+	// apply the comments again, without asking for approval twice.
+	if opts.Approve != nil {
+		approved := make(map[string]string, len(result.Applied))
+		for _, c := range result.Applied {
+			approved[c.Name] = c.Text
+		}
+		opts.Approve = func(p Proposal) (string, bool) {
+			text, ok := approved[p.Name]
+			return text, ok
+		}
+	}
+	lines := strings.SplitAfter(goCode, "\n")
+	var sb strings.Builder
+	for i, line := range lines {
+		for _, c := range crowded {
+			if c == i+1 {
+				sb.WriteString("\n")
+			}
+		}
+		sb.WriteString(line)
+	}
+	result, _, err = addComments(sb.String(), comments, opts)
+	if err != nil {
+		return result, err
+	}
+	// Report the lines of the source passed in.
+	for i := range result.Applied {
+		inserted := 0
+		for j, c := range crowded {
+			if c+j+1 <= result.Applied[i].Line {
+				inserted++
+			}
+		}
+		result.Applied[i].Line -= inserted
+	}
+	return result, nil
+}
+
+// limitComments returns opts with Approve wrapped to drop the comments
+// beyond opts.MaxComments, found with a first pass over the code. The
+// comments of exported declarations are kept first, then those that come
+// first in the source, and only these are passed on for approval.
+func limitComments(goCode string, comments []Comment, opts Options) (Options, error) {
+	limited := opts
+	limited.MaxComments = 0
+	trial := limited
+	trial.Style = StyleLine
+	trial.Approve = nil
+	result, err := AddComments(goCode, comments, trial)
+	if err != nil || len(result.Applied) <= opts.MaxComments {
+		return limited, err
+	}
+
+	applied := append([]AppliedComment(nil), result.Applied...)
+	sort.SliceStable(applied, func(i, j int) bool {
+		return exportedName(applied[i].Name) && !exportedName(applied[j].Name)
+	})
+	keep := make(map[string]bool, opts.MaxComments)
+	for _, c := range applied[:opts.MaxComments] {
+		keep[c.Name] = true
+	}
+	limited.Approve = func(p Proposal) (string, bool) {
+		if !keep[p.Name] {
+			return "", false
+		}
+		return approve(opts, p.Name, p.Code, p.Text)
+	}
+	return limited, nil
+}
+
+// exportedName reports whether every part of a declaration name as in
+// AppliedComment, such as "Server.Start", is exported.
+func exportedName(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if !ast.IsExported(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// addBlockComments implements AddComments for StyleBlock. The printer
+// can't place multi-line block comments added to the AST, since it takes
+// their lines from positions in the source, so the comments are matched on
+// the AST but inserted as text, which is then formatted.
+func addBlockComments(goCode string, comments []Comment, opts Options) (AddResult, error) {
+	lineOpts := opts
+	lineOpts.Style = StyleLine
+	result, err := AddComments(goCode, comments, lineOpts)
+	if err != nil {
+		return result, err
+	}
+	formatted, err := format.Source([]byte(spliceComments(goCode, result.Applied, opts)))
+	if err != nil {
+		return AddResult{}, fmt.Errorf("formatting Go code: %v", err)
+	}
+	result.Code, err = preserveHeader(goCode, string(formatted))
+	if err != nil {
+		return AddResult{}, fmt.Errorf("parsing Go code: %v", err)
+	}
+	return result, nil
+}
+
+// addComments does the work of AddComments. It also returns the lines of
+// the declarations that got a comment but directly follow other code, whose
+// comments are printed as trailing comments of that code instead.
+func addComments(goCode string, comments []Comment, opts Options) (AddResult, []int, error) {
+	// Parse Go code into an AST (Abstract Syntax Tree).
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", goCode, parser.ParseComments)
+	if err != nil {
+		return AddResult{}, nil, fmt.Errorf("parsing Go code: %v", err)
+	}
+
+	// Create an ast.CommentMap from the ast.File's comments.
+	// This helps keeping the association between comments
+	// and AST nodes.
+	cmap := ast.NewCommentMap(fset, node, node.Comments)
+	if cmap == nil {
+		// NewCommentMap returns nil for files without any comments.
+		cmap = make(ast.CommentMap)
+	}
+
+	// Traverse the AST to find comment positions and add comments.
+	var result AddResult
+	var crowded []int
+	matched := make([]bool, len(comments))
+	pkgDoc, ok := packageCommentFor(node, comments, matched, opts)
+	if ok {
+		result.Applied = append(result.Applied, AppliedComment{
+			Name: "package " + node.Name.Name,
+			Line: fset.Position(node.Package).Line,
+			Text: pkgDoc,
+		})
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncDecl:
+			if initFunc(x) {
+				return false
+			}
+			sig := funcSignature(fset, x)
+			var text string
+			var ok bool
+			if x.Recv != nil && len(x.Recv.List) > 0 {
+				text, ok = addMethodComments(cmap, sig, x, comments, matched, opts)
+			} else {
+				text, ok = addFunctionComments(cmap, sig, x, comments, matched, opts)
+			}
+			if ok {
+				result.Applied = append(result.Applied, AppliedComment{
+					Name: funcKey(x),
+					Line: fset.Position(x.Pos()).Line,
+					Text: text,
+				})
+				if crowdedLine(fset, goCode, node.Comments, x.Pos()) {
+					crowded = append(crowded, fset.Position(x.Pos()).Line)
+				}
+			}
+			// Don't descend into the body, declarations there aren't
+			// documented.
+			return false
+		case *ast.GenDecl:
+			if x.Tok == token.TYPE {
+				for _, spec := range x.Specs {
+					ts := spec.(*ast.TypeSpec)
+					code := "type " + nodeString(fset, ts)
+					if text, ok := addTypeComments(cmap, code, x, ts, comments, matched, opts); ok {
+						result.Applied = append(result.Applied, AppliedComment{
+							Name: ts.Name.Name,
+							Line: fset.Position(ts.Pos()).Line,
+							Text: text,
+						})
+						if crowdedLine(fset, goCode, node.Comments, x.Pos()) {
+							crowded = append(crowded, fset.Position(x.Pos()).Line)
+						}
+					}
+					if it, ok := ts.Type.(*ast.InterfaceType); ok {
+						for _, method := range it.Methods.List {
+							if onOpeningLine(fset, it.Methods, method) {
+								continue
+							}
+							if text, ok := addInterfaceMethodComments(cmap, fset, ts.Name.Name, method, comments, matched, opts); ok {
+								result.Applied = append(result.Applied, AppliedComment{
+									Name: ts.Name.Name + "." + fieldName(method),
+									Line: fset.Position(method.Pos()).Line,
+									Text: text,
+								})
+							}
+						}
+					}
+					if st, ok := ts.Type.(*ast.StructType); ok && opts.Fields && opts.includes(ts.Name.Name) {
+						for _, field := range st.Fields.List {
+							if onOpeningLine(fset, st.Fields, field) {
+								continue
+							}
+							if text, ok := addFieldComments(cmap, fset, ts.Name.Name, field, comments, matched, opts); ok {
+								result.Applied = append(result.Applied, AppliedComment{
+									Name: ts.Name.Name + "." + fieldName(field),
+									Line: fset.Position(field.Pos()).Line,
+									Text: text,
+								})
+							}
+						}
+					}
+				}
+			}
+			if x.Tok == token.VAR || x.Tok == token.CONST {
+				for _, spec := range x.Specs {
+					vs := spec.(*ast.ValueSpec)
+					if x.Lparen.IsValid() && fset.Position(vs.Pos()).Line == fset.Position(x.Lparen).Line {
+						// As in "const (A = 1)", where a doc comment
+						// doesn't fit.
+						continue
+					}
+					code := x.Tok.String() + " " + nodeString(fset, vs)
+					if text, ok := addValueComments(cmap, code, x, vs, comments, matched, opts); ok {
+						result.Applied = append(result.Applied, AppliedComment{
+							Name: vs.Names[0].Name,
+							Line: fset.Position(vs.Pos()).Line,
+							Text: text,
+						})
+						if crowdedLine(fset, goCode, node.Comments, x.Pos()) {
+							crowded = append(crowded, fset.Position(x.Pos()).Line)
+						}
+					}
+				}
+			}
+			return false
+		}
+		return true
+	})
+
+	// Use the comment map to filter comments that don't belong anymore
+	// (the comments associated with the variable declaration), and create
+	// the new comments list.
+	node.Comments = cmap.Filter(node).Comments()
+
+	// Write the modified AST back to a string.
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, node); err != nil {
+		return AddResult{}, nil, fmt.Errorf("formatting Go code: %v", err)
+	}
+	// Build constraints and license headers must stay where they were.
+	result.Code, err = preserveHeader(goCode, buf.String())
+	if err != nil {
+		return AddResult{}, nil, fmt.Errorf("parsing Go code: %v", err)
+	}
+	if ok {
+		result.Code, err = insertPackageComment(result.Code, pkgDoc, opts)
+		if err != nil {
+			return AddResult{}, nil, fmt.Errorf("parsing Go code: %v", err)
+		}
+	}
+
+	for i, comment := range comments {
+		if !matched[i] {
+			result.Unmatched = append(result.Unmatched, comment)
+		}
+	}
+	return result, crowded, nil
+}
+
+// crowdedLine reports whether the declaration at pos starts a line directly
+// below other code. Doc comments are positioned just before the declaration,
+// which is then on the line above, so the printer would attach them to that
+// code as trailing comments. The same goes for a declaration below a blank
+// line and a comment, free-floating or trailing code, which the doc comment
+// would be joined with.
+func crowdedLine(fset *token.FileSet, src string, comments []*ast.CommentGroup, pos token.Pos) bool {
+	// Offsets and columns count bytes, so slicing at them never splits a
+	// multibyte character, but guard against a position outside src.
+	p := fset.Position(pos)
+	if p.Column != 1 || p.Line == 1 || p.Offset > len(src) {
+		return false
+	}
+	prevStart := strings.LastIndexByte(src[:p.Offset-1], '\n') + 1
+	prev := strings.TrimSpace(src[prevStart : p.Offset-1])
+	if prev == "" {
+		for _, c := range comments {
+			if fset.Position(c.End()).Line == p.Line-2 {
+				return true
+			}
+		}
+		return false
+	}
+	return prev != "" && !isCommentLine(prev)
+}
+
+// isCommentLine reports whether the trimmed line ends in a comment without
+// code after it.
+func isCommentLine(line string) bool {
+	return strings.HasPrefix(line, "//") || strings.HasSuffix(line, "*/")
+}
+
+// addFunctionComments adds comments to function declarations based on position,
+// marking the comment found in matched and returning the text applied.
+// Declarations that already have a doc comment are skipped unless
+// opts.Overwrite is set, in which case the old doc comment is replaced.
+func addFunctionComments(cmap ast.CommentMap, sig string, decl *ast.FuncDecl, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findFuncComment(sig, decl, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	if documented(decl.Doc) && !opts.Overwrite {
+		return "", false
+	}
+	if !opts.includes(decl.Name.Name) || !opts.inLines(funcKey(decl)) {
+		return "", false
+	}
+	text := comments[i].Comment
+	if opts.GodocStyle {
+		text = godocComment(text, decl.Name.Name, false)
+	}
+	text, ok = approve(opts, funcKey(decl), sig, text)
+	if !ok {
+		return "", false
+	}
+	decl.Doc = setDoc(cmap, decl, decl.Doc, text, opts)
+	return text, true
+}
+
+// addMethodComments adds comments to method declarations based on position,
+// marking the comment found in matched and returning the text applied.
+// A receiver qualification is removed from the start of the comment, and
+// with opts.GodocStyle it is made to start with the method name, e.g.
+// "Start ..." instead of "Server.Start ...".
+func addMethodComments(cmap ast.CommentMap, sig string, decl *ast.FuncDecl, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findFuncComment(sig, decl, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	if documented(decl.Doc) && !opts.Overwrite {
+		return "", false
+	}
+	if !opts.includes(decl.Name.Name) || !opts.inLines(funcKey(decl)) {
+		return "", false
+	}
+	recv := receiverTypeName(decl.Recv.List[0].Type)
+	text := stripReceiverPrefix(comments[i].Comment, recv, decl.Name.Name)
+	if opts.GodocStyle {
+		text = godocComment(text, decl.Name.Name, false)
+	}
+	text, ok = approve(opts, funcKey(decl), sig, text)
+	if !ok {
+		return "", false
+	}
+	decl.Doc = setDoc(cmap, decl, decl.Doc, text, opts)
+	return text, true
+}
+
+// addTypeComments adds comments to type declarations based on position,
+// marking the comment found in matched and returning the text applied. A
+// type declared on its own is documented on decl, one in a group on spec.
+func addTypeComments(cmap ast.CommentMap, code string, decl *ast.GenDecl, spec *ast.TypeSpec, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findTypeComment(spec, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	grouped := decl.Lparen.IsValid()
+	doc := decl.Doc
+	if grouped {
+		doc = spec.Doc
+	}
+	if documented(doc) && !opts.Overwrite {
+		return "", false
+	}
+	if !opts.includes(spec.Name.Name) || !opts.inLines(spec.Name.Name) {
+		return "", false
+	}
+	text := comments[i].Comment
+	if opts.GodocStyle {
+		text = godocComment(text, spec.Name.Name, true)
+	}
+	text, ok = approve(opts, spec.Name.Name, code, text)
+	if !ok {
+		return "", false
+	}
+	if grouped {
+		spec.Doc = setDoc(cmap, spec, spec.Doc, text, opts)
+	} else {
+		decl.Doc = setDoc(cmap, decl, decl.Doc, text, opts)
+	}
+	return text, true
+}
+
+// addValueComments adds comments to variable and constant declarations
+// based on position, marking the comment found in matched and returning the
+// text applied. A declaration on its own is documented on decl, one in a
+// group on spec, unless the group has a doc comment, which covers all of
+// its specs.
+func addValueComments(cmap ast.CommentMap, code string, decl *ast.GenDecl, spec *ast.ValueSpec, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findValueComment(spec, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	grouped := decl.Lparen.IsValid()
+	if grouped && documented(decl.Doc) {
+		return "", false
+	}
+	doc := decl.Doc
+	if grouped {
+		doc = spec.Doc
+	}
+	if documented(doc) && !opts.Overwrite {
+		return "", false
+	}
+	if !specIncluded(spec, opts) {
+		return "", false
+	}
+	name := spec.Names[0].Name
+	text := comments[i].Comment
+	if opts.GodocStyle {
+		text = godocComment(text, name, false)
+	}
+	text, ok = approve(opts, name, code, text)
+	if !ok {
+		return "", false
+	}
+	if grouped {
+		spec.Doc = setDoc(cmap, spec, spec.Doc, text, opts)
+	} else {
+		decl.Doc = setDoc(cmap, decl, decl.Doc, text, opts)
+	}
+	return text, true
+}
+
+// addFieldComments adds comments to the exported fields of the struct type
+// typeName based on position, marking the comment found in matched and
+// returning the text applied. Fields with a trailing comment are considered
+// documented, and fields declared together, as in "X, Y int", share one
+// comment.
+func addFieldComments(cmap ast.CommentMap, fset *token.FileSet, typeName string, field *ast.Field, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findFieldComment(typeName, field, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	if (documented(field.Doc) && !opts.Overwrite) || documented(field.Comment) {
+		return "", false
+	}
+	name := fieldName(field)
+	if !ast.IsExported(name) || !opts.inLines(typeName+"."+name) {
+		return "", false
+	}
+	text := comments[i].Comment
+	if opts.GodocStyle {
+		text = godocComment(text, name, false)
+	}
+	text, ok = approve(opts, typeName+"."+name, nodeString(fset, field), text)
+	if !ok {
+		return "", false
+	}
+	field.Doc = setDoc(cmap, field, field.Doc, text, opts)
+	return text, true
+}
+
+// addInterfaceMethodComments adds comments to the methods of the interface
+// type typeName based on position, marking the comment found in matched and
+// returning the text applied. Embedded interfaces and type constraints are
+// skipped.
+func addInterfaceMethodComments(cmap ast.CommentMap, fset *token.FileSet, typeName string, method *ast.Field, comments []Comment, matched []bool, opts Options) (string, bool) {
+	if len(method.Names) == 0 {
+		return "", false
+	}
+	name := method.Names[0].Name
+	i, ok := findFieldComment(typeName, method, comments)
+	if !ok {
+		i, ok = findInterfaceMethodComment(name, comments, matched)
+	}
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	if (documented(method.Doc) && !opts.Overwrite) || documented(method.Comment) {
+		return "", false
+	}
+	if !opts.includes(name) || !opts.inLines(typeName+"."+name) {
+		return "", false
+	}
+	text := stripReceiverPrefix(comments[i].Comment, typeName, name)
+	if opts.GodocStyle {
+		text = godocComment(text, name, false)
+	}
+	text, ok = approve(opts, typeName+"."+name, nodeString(fset, method), text)
+	if !ok {
+		return "", false
+	}
+	method.Doc = setDoc(cmap, method, method.Doc, text, opts)
+	return text, true
+}
+
+// onOpeningLine reports whether field is on the line of the opening brace of
+// list, as in "interface{ Close() error }", where a doc comment doesn't fit.
+func onOpeningLine(fset *token.FileSet, list *ast.FieldList, field *ast.Field) bool {
+	return fset.Position(field.Pos()).Line == fset.Position(list.Opening).Line
+}
+
+// fieldName returns the first name of field, or the type name of an
+// embedded field.
+func fieldName(field *ast.Field) string {
+	if len(field.Names) > 0 {
+		return field.Names[0].Name
+	}
+	t := field.Type
+	if star, ok := t.(*ast.StarExpr); ok {
+		t = star.X
+	}
+	if sel, ok := t.(*ast.SelectorExpr); ok {
+		return sel.Sel.Name
+	}
+	return receiverTypeName(t)
+}
+
+// approve asks opts.Approve, if set, whether text should be added as the doc
+// comment of the declaration name, and returns the text to use.
+func approve(opts Options, name, code, text string) (string, bool) {
+	if opts.Approve == nil {
+		return text, true
+	}
+	return opts.Approve(Proposal{Name: name, Code: code, Text: text})
+}
+
+// nodeString prints node, or returns an empty string if that fails.
+func nodeString(fset *token.FileSet, node ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, node); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// directiveRe matches the comment lines that are directives rather than
+// documentation, such as //go:generate, //go:embed and //nolint:errcheck, as
+// go/ast tells them apart.
+var directiveRe = regexp.MustCompile(`^//(?:line |extern |export |[a-z0-9]+:[a-z0-9])`)
+
+// isDirective reports whether the comment text, including the comment
+// markers, is a directive.
+func isDirective(text string) bool {
+	return directiveRe.MatchString(text)
+}
+
+// documented reports whether doc holds any documentation. The parser makes
+// directives directly above a declaration its doc comment, but a
+// declaration with nothing else above it is undocumented.
+func documented(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if !isDirective(c.Text) && strings.TrimSpace(strings.TrimPrefix(c.Text, "//")) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setDoc returns the doc comment for node holding text, replacing the old
+// doc comment in the comment map. Each line of text, wrapped at opts.Wrap
+// columns, becomes a "// " line. Directives in the old doc comment are kept
+// at its end, separated by an empty comment line as gofmt does.
+func setDoc(cmap ast.CommentMap, node ast.Node, old *ast.CommentGroup, text string, opts Options) *ast.CommentGroup {
+	// Put the new doc comment on the last line of the old one, so that the
+	// printer doesn't see a gap above the declaration and add a blank line.
+	slash := node.Pos() - 1
+	if old != nil {
+		slash = old.List[len(old.List)-1].Slash
+	}
+	doc := &ast.CommentGroup{}
+	for _, line := range commentLines(text, opts) {
+		doc.List = append(doc.List, &ast.Comment{Slash: slash, Text: line})
+	}
+	if old != nil {
+		var directives []*ast.Comment
+		for _, c := range old.List {
+			if isDirective(c.Text) {
+				directives = append(directives, &ast.Comment{Slash: slash, Text: c.Text})
+			}
+		}
+		if len(directives) > 0 {
+			doc.List = append(doc.List, &ast.Comment{Slash: slash, Text: "//"})
+			doc.List = append(doc.List, directives...)
+		}
+	}
+	// Detach the old doc comment from the comment map, otherwise
+	// format.Node would emit both the old and the new comment.
+	groups := []*ast.CommentGroup{doc}
+	for _, g := range cmap[node] {
+		if g != old {
+			groups = append(groups, g)
+		}
+	}
+	cmap[node] = groups
+	return doc
+}
+
+// commentLines returns the lines of the comment holding text, wrapped at
+// opts.Wrap columns. Each line becomes a "// " line, or with StyleBlock a
+// comment of more than one line becomes a /* */ block with the comment
+// markers on lines of their own.
+func commentLines(text string, opts Options) []string {
+	wrapped := wrapComment(text, opts.Wrap)
+	if opts.Style == StyleBlock && len(wrapped) > 1 {
+		lines := append([]string{"/*"}, wrapped...)
+		return append(lines, "*/")
+	}
+	lines := make([]string, len(wrapped))
+	for i, line := range wrapped {
+		lines[i] = "//"
+		if line != "" {
+			lines[i] += " " + line
+		}
+	}
+	return lines
+}
+
+// wrapComment splits comment text into lines at its embedded newlines and
+// wraps each of them at word boundaries so that, including the "// "
+// marker, no line is longer than width columns unless a single word is.
+// A width of zero or less disables wrapping.
+func wrapComment(text string, width int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t")
+		if width <= 0 || len("// ")+utf8.RuneCountInString(line) <= width {
+			lines = append(lines, line)
+			continue
+		}
+		var current string
+		for _, word := range strings.Fields(line) {
+			if current != "" && len("// ")+utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > width {
+				lines = append(lines, current)
+				current = ""
+			}
+			if current != "" {
+				current += " "
+			}
+			current += word
+		}
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// stripReceiverPrefix removes a receiver qualification such as "Server.",
+// "(*Server)." or "(s *Server) " in front of the method name at the start of
+// text.
+func stripReceiverPrefix(text, recv, name string) string {
+	re := regexp.MustCompile(`^(\s*(?:\(\s*(?:` + identPattern + `\s+)?\*?` + regexp.QuoteMeta(recv) + `(?:\[[^\]]*\])?\s*\)\s*\.?\s*|\*?` +
+		regexp.QuoteMeta(recv) + `(?:\[[^\]]*\])?\.)` + regexp.QuoteMeta(name) + `)` + identEndPattern)
+	if loc := re.FindStringSubmatchIndex(text); loc != nil {
+		return name + text[loc[3]:]
+	}
+	return text
+}
+
+// leadingClauseRe matches an opening such as "This function" or "The struct"
+// that refers to the declaration instead of naming it.
+var leadingClauseRe = regexp.MustCompile(`^(?:[Tt]his|[Tt]he)\s+(?:function|func|method|type|struct|structure|interface)\b[\s,:]*`)
+
+// nounPhraseRe matches a comment that opens with a noun phrase, as in "The
+// unit length.", which describes the declaration without a verb.
+var nounPhraseRe = regexp.MustCompile(`^(?:A|An|The)\s+\p{Ll}`)
+
+// godocComment rewrites text to follow the godoc convention of starting with
+// name. A leading clause such as "This function" is replaced by name, and
+// for types an article before the name, as in "A Server ...", is kept. A
+// noun phrase, as in "The unit length.", becomes "Unit is the unit length.".
+func godocComment(text, name string, allowArticle bool) string {
+	text = strings.TrimSpace(text)
+	if allowArticle {
+		re := regexp.MustCompile(`^(?:A|An|The)\s+` + regexp.QuoteMeta(name) + identEndPattern)
+		if re.MatchString(text) {
+			return text
+		}
+	}
+	text = leadingClauseRe.ReplaceAllString(text, "")
+	if startsWithName(text, name) {
+		return text
+	}
+	if nounPhraseRe.MatchString(text) {
+		return name + " is " + strings.ToLower(text[:1]) + text[1:]
+	}
+	return ensureNamePrefix(text, name)
+}
+
+// ensureNamePrefix makes text start with name, as godoc expects. If the first
+// word is something else, name is prepended and the old first letter is
+// lowercased unless it starts an acronym or identifier.
+func ensureNamePrefix(text, name string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return name
+	}
+	if startsWithName(text, name) {
+		return text
+	}
+
+	r, size := utf8.DecodeRuneInString(text)
+	next, _ := utf8.DecodeRuneInString(text[size:])
+	if unicode.IsUpper(r) && !unicode.IsUpper(next) {
+		text = string(unicode.ToLower(r)) + text[size:]
+	}
+	return name + " " + text
+}
+
+// startsWithName reports whether the first word of text is name.
+func startsWithName(text, name string) bool {
+	first := strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == '.' || r == ':'
+	})
+	return len(first) > 0 && first[0] == name
+}
+
+// findTypeComment returns the index of the comment whose position declares
+// the type of spec, e.g. "type Server struct {" or, within a group,
+// "Server struct {".
+func findTypeComment(spec *ast.TypeSpec, comments []Comment) (int, bool) {
+	for i, comment := range comments {
+		m := positionTypeRe.FindStringSubmatch(strings.TrimSpace(comment.Position))
+		if m != nil && m[1] == spec.Name.Name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// findValueComment returns the index of the comment whose position names
+// one of the variables or constants declared by spec, e.g. "var ErrClosed"
+// or "const MaxSize = 1 << 20".
+func findValueComment(spec *ast.ValueSpec, comments []Comment) (int, bool) {
+	for i, comment := range comments {
+		m := positionValueRe.FindStringSubmatch(strings.TrimSpace(comment.Position))
+		if m == nil {
+			continue
+		}
+		for _, ident := range spec.Names {
+			if m[1] == ident.Name {
+				return i, true
+			}
+		}
+	}
+	return -1, false
+}
+
+// findFieldComment returns the index of the comment whose position names
+// field of the struct type typeName, e.g. "Server.Addr". Any of the names of
+// a field declared together with others matches.
+func findFieldComment(typeName string, field *ast.Field, comments []Comment) (int, bool) {
+	names := []string{fieldName(field)}
+	for _, ident := range field.Names {
+		names = append(names, ident.Name)
+	}
+	for i, comment := range comments {
+		m := positionFieldRe.FindStringSubmatch(strings.TrimSpace(comment.Position))
+		if m == nil || m[1] != typeName {
+			continue
+		}
+		for _, name := range names {
+			if m[2] == name {
+				return i, true
+			}
+		}
+	}
+	return -1, false
+}
+
+// findInterfaceMethodComment returns the index of a comment not matched yet
+// whose position is the bare method line, e.g. "Get(key string) string",
+// which models sometimes return instead of "Store.Get".
+func findInterfaceMethodComment(name string, comments []Comment, matched []bool) (int, bool) {
+	for i, comment := range comments {
+		m := positionMethodRe.FindStringSubmatch(strings.TrimSpace(comment.Position))
+		if m != nil && m[1] == name && !matched[i] {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// findFuncComment returns the index of the comment whose position refers to
+// decl. An exact match on the normalized signature wins; otherwise the
+// receiver type and function name parsed from the position must both match
+// the declaration, so that methods of the same name on different types, such
+// as (*A).Close and (*B).Close, each get their own comment.
+func findFuncComment(sig string, decl *ast.FuncDecl, comments []Comment) (int, bool) {
+	for i, comment := range comments {
+		if normalizePosition(comment.Position) == sig {
+			return i, true
+		}
+	}
+	key := funcKey(decl)
+	for i, comment := range comments {
+		if k, ok := positionFuncKey(comment.Position); ok && k == key {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// identPattern matches a Go identifier, which may contain any Unicode
+// letters and digits, unlike \w. identEndPattern matches what may follow
+// one, in place of \b, which only knows ASCII word characters.
+const (
+	identPattern    = `[\p{L}_][\p{L}\p{Nd}_]*`
+	identEndPattern = `(?:[^\p{L}\p{Nd}_]|$)`
+)
+
+var (
+	// spaceRe matches runs of whitespace.
+	spaceRe = regexp.MustCompile(`\s+`)
+	// positionFuncRe captures the receiver type and name of a function
+	// signature, e.g. "Server" and "Start" in "func (s *Server) Start() {".
+	positionFuncRe = regexp.MustCompile(`^func\s*(?:\(\s*(?:` + identPattern + `\s+)?\*?\s*(` + identPattern + `)[^)]*\))?\s*(` + identPattern + `)`)
+	// positionTypeRe captures the name of a type declaration, e.g. "Server"
+	// in "type Server struct {", but not in the field position
+	// "Server.Addr".
+	positionTypeRe = regexp.MustCompile(`^(?:type\s+)?(` + identPattern + `)(?:[^.\p{L}\p{Nd}_]|$)`)
+	// positionFieldRe captures the struct and field name of a field
+	// position, e.g. "Server" and "Addr" in "Server.Addr string". A package
+	// qualifier or pointer of an embedded field, as in "Server.*sync.Mutex",
+	// is skipped.
+	positionFieldRe = regexp.MustCompile(`^(?:type\s+)?(` + identPattern + `)\.\*?(?:` + identPattern + `\.)?(` + identPattern + `)`)
+	// positionValueRe captures the name of a variable or constant
+	// declaration, e.g. "ErrClosed" in "var ErrClosed = errors.New(...)".
+	positionValueRe = regexp.MustCompile(`^(?:var|const)\s+(` + identPattern + `)`)
+	// positionMethodRe captures the name of an interface method line, e.g.
+	// "Get" in "Get(key string) string".
+	positionMethodRe = regexp.MustCompile(`^(` + identPattern + `)\s*\(`)
+)
+
+// dedupeComments returns the comments with at most one per position, the
+// first, and the duplicates dropped. Positions are compared normalized, so
+// that "func F() {" and "func F()" count as the same.
+func dedupeComments(comments []Comment) (kept, dropped []Comment) {
+	seen := make(map[string]bool, len(comments))
+	for _, c := range comments {
+		pos := normalizePosition(c.Position)
+		if seen[pos] {
+			dropped = append(dropped, c)
+			continue
+		}
+		seen[pos] = true
+		kept = append(kept, c)
+	}
+	return kept, dropped
+}
+
+// normalizePosition collapses whitespace and drops the opening brace so that
+// signatures can be compared regardless of formatting.
+func normalizePosition(position string) string {
+	position = strings.TrimSpace(position)
+	position = strings.TrimSuffix(position, "{")
+	position = spaceRe.ReplaceAllString(position, " ")
+	position = strings.ReplaceAll(position, "( ", "(")
+	position = strings.ReplaceAll(position, ", )", ")")
+	position = strings.ReplaceAll(position, " )", ")")
+	return strings.TrimSpace(position)
+}
+
+// funcSignature prints the signature of decl, including receiver, name,
+// parameters and results, in normalized form.
+func funcSignature(fset *token.FileSet, decl *ast.FuncDecl) string {
+	sig := *decl
+	sig.Doc = nil
+	sig.Body = nil
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, &sig); err != nil {
+		return ""
+	}
+	return normalizePosition(buf.String())
+}
+
+// initFunc reports whether decl is an init function. A file may have
+// several, which can't be told apart by position and can't be referred to,
+// so they don't get comments.
+func initFunc(decl *ast.FuncDecl) bool {
+	return decl.Recv == nil && decl.Name.Name == "init"
+}
+
+// funcKey identifies decl by its receiver type and name, e.g. "Server.Start"
+// for a method or "main" for a plain function.
+func funcKey(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	return receiverTypeName(decl.Recv.List[0].Type) + "." + decl.Name.Name
+}
+
+// receiverTypeName returns the base type name of a receiver expression,
+// stripping pointers and type parameters.
+func receiverTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverTypeName(t.X)
+	case *ast.ParenExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// positionFuncKey parses a function position returned by the model into the
+// same form as funcKey.
+func positionFuncKey(position string) (string, bool) {
+	m := positionFuncRe.FindStringSubmatch(strings.TrimSpace(position))
+	if m == nil {
+		return "", false
+	}
+	if m[1] == "" {
+		return m[2], true
+	}
+	return m[1] + "." + m[2], true
+}
@@ -0,0 +1,489 @@
+package gocmt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		comments []Comment
+		opts     Options
+		want     string
+	}{
+		{
+			name:     "function",
+			src:      "package p\n\nfunc F() {}\n",
+			comments: []Comment{{Position: "func F() {", Comment: "F does nothing."}},
+			want:     "package p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name:     "type",
+			src:      "package p\n\ntype T struct {\n\tX int\n}\n",
+			comments: []Comment{{Position: "type T struct {", Comment: "T holds X."}},
+			want:     "package p\n\n// T holds X.\ntype T struct {\n\tX int\n}\n",
+		},
+		{
+			name:     "already commented",
+			src:      "package p\n\n// F is documented.\nfunc F() {}\n",
+			comments: []Comment{{Position: "func F() {", Comment: "F does nothing."}},
+			want:     "package p\n\n// F is documented.\nfunc F() {}\n",
+		},
+		{
+			name:     "overwrite",
+			src:      "package p\n\n// F is documented.\nfunc F() {}\n",
+			comments: []Comment{{Position: "func F() {", Comment: "F does nothing."}},
+			opts:     Options{Overwrite: true},
+			want:     "package p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name:     "below a trailing comment",
+			src:      "package p\n\nvar x = 1 // one\n\ntype T struct{}\n",
+			comments: []Comment{{Position: "type T struct{}", Comment: "T is empty."}},
+			want:     "package p\n\nvar x = 1 // one\n\n// T is empty.\ntype T struct{}\n",
+		},
+		{
+			name: "init functions",
+			src:  "package p\n\nfunc init() {}\n\nfunc init() {}\n",
+			comments: []Comment{
+				{Position: "func init() {", Comment: "init registers the driver."},
+				{Position: "func init() {", Comment: "init sets the defaults."},
+			},
+			want: "package p\n\nfunc init() {}\n\nfunc init() {}\n",
+		},
+		{
+			name:     "wrapped",
+			src:      "package p\n\nfunc F() {}\n",
+			comments: []Comment{{Position: "func F() {", Comment: "F does nothing at all, which is exactly what it is meant to do."}},
+			opts:     Options{Wrap: 40},
+			want:     "package p\n\n// F does nothing at all, which is\n// exactly what it is meant to do.\nfunc F() {}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(tt.src, tt.comments, tt.opts)
+			if err != nil {
+				t.Fatalf("AddComments() error = %v", err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCommentsSharedPrefix(t *testing.T) {
+	src := "package p\n\ntype M struct{}\n\nfunc (m *M) Get() int { return 0 }\n\nfunc (m *M) GetAll() []int { return nil }\n\nfunc Get(key string) int { return 0 }\n\nfunc GetOr(key string, def int) int { return def }\n"
+	want := "package p\n\ntype M struct{}\n\n// Get returns one.\nfunc (m *M) Get() int { return 0 }\n\n// GetAll returns all.\nfunc (m *M) GetAll() []int { return nil }\n\n// Get returns the value of key.\nfunc Get(key string) int { return 0 }\n\n// GetOr returns the value of key or def.\nfunc GetOr(key string, def int) int { return def }\n"
+	// The longer signatures come first, so that a match on a prefix would
+	// put their comments on the shorter ones.
+	comments := []Comment{
+		{Position: "func GetOr(key string, def int) int {", Comment: "GetOr returns the value of key or def."},
+		{Position: "func (m *M) GetAll() []int {", Comment: "GetAll returns all."},
+		{Position: "func Get(key string) int {", Comment: "Get returns the value of key."},
+		{Position: "func (m *M) Get() int {", Comment: "Get returns one."},
+	}
+	result, err := AddComments(src, comments, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != want {
+		t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, want)
+	}
+	if len(result.Unmatched) != 0 {
+		t.Errorf("AddComments() unmatched %v", result.Unmatched)
+	}
+}
+
+func TestAddCommentsReceivers(t *testing.T) {
+	src := "package p\n\ntype Server struct{ name string }\n\nfunc (s *Server) Start() error { return nil }\n\nfunc (s Server) Name() string { return s.name }\n"
+	tests := []struct {
+		name                string
+		startDoc, nameDoc   string
+		opts                Options
+		wantStart, wantName string
+	}{
+		{"method names", "Start starts the server.", "Name returns the name.", Options{}, "Start starts the server.", "Name returns the name."},
+		{"qualified names", "Server.Start starts the server.", "(s Server) Name returns the name.", Options{}, "Start starts the server.", "Name returns the name."},
+		{"pointer qualified", "(*Server).Start starts the server.", "Server.Name returns the name.", Options{}, "Start starts the server.", "Name returns the name."},
+		{"without names", "Starts the server.", "This method returns the name.", Options{GodocStyle: true}, "Start starts the server.", "Name returns the name."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comments := []Comment{
+				{Position: "func (s *Server) Start() error {", Comment: tt.startDoc},
+				{Position: "func (s Server) Name() string {", Comment: tt.nameDoc},
+			}
+			result, err := AddComments(src, comments, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "package p\n\ntype Server struct{ name string }\n\n// " + tt.wantStart + "\nfunc (s *Server) Start() error { return nil }\n\n// " + tt.wantName + "\nfunc (s Server) Name() string { return s.name }\n"
+			if result.Code != want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, want)
+			}
+		})
+	}
+}
+
+func TestAddCommentsGodocStyle(t *testing.T) {
+	src := "package p\n\ntype Cache struct{}\n\nfunc (c *Cache) Get(key string) string { return \"\" }\n\nfunc NewCache() *Cache { return &Cache{} }\n"
+	comments := []Comment{
+		{Position: "type Cache struct{}", Comment: "This struct stores values in memory."},
+		{Position: "func (c *Cache) Get(key string) string {", Comment: "The method returns the value of key."},
+		{Position: "func NewCache() *Cache {", Comment: "Creates an empty cache."},
+	}
+	tests := []struct {
+		name       string
+		godocStyle bool
+		want       string
+	}{
+		{
+			name:       "rewritten",
+			godocStyle: true,
+			want:       "package p\n\n// Cache stores values in memory.\ntype Cache struct{}\n\n// Get returns the value of key.\nfunc (c *Cache) Get(key string) string { return \"\" }\n\n// NewCache creates an empty cache.\nfunc NewCache() *Cache { return &Cache{} }\n",
+		},
+		{
+			name: "as returned",
+			want: "package p\n\n// This struct stores values in memory.\ntype Cache struct{}\n\n// The method returns the value of key.\nfunc (c *Cache) Get(key string) string { return \"\" }\n\n// Creates an empty cache.\nfunc NewCache() *Cache { return &Cache{} }\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(src, comments, Options{GodocStyle: tt.godocStyle})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCommentsIdempotent(t *testing.T) {
+	src := `package p
+
+import "io"
+
+type A struct{}
+
+type B struct {
+	Name string
+}
+
+type (
+	X int
+	Y interface {
+		io.Closer
+		Do() error
+	}
+)
+
+const (
+	One = 1
+	Two = 2
+)
+
+var ErrClosed error
+
+func (a *A) Close() error { return nil }
+
+func (b B) Close() error { return nil }
+
+func New() *A { return &A{} }
+`
+	comments := []Comment{
+		{Position: "package p", Comment: "Package p has a bit of everything."},
+		{Position: "type A struct{}", Comment: "A is a closer."},
+		{Position: "type B struct {", Comment: "B is another closer."},
+		{Position: "B.Name", Comment: "Name is the name of b."},
+		{Position: "X int", Comment: "X is an int."},
+		{Position: "Y interface {", Comment: "Y does things."},
+		{Position: "Y.Do", Comment: "Do does it."},
+		{Position: "const One", Comment: "One is one."},
+		{Position: "const Two", Comment: "Two is two."},
+		{Position: "var ErrClosed error", Comment: "ErrClosed is returned after Close."},
+		{Position: "func (a *A) Close() error {", Comment: "Close closes a."},
+		{Position: "func (b B) Close() error {", Comment: "Close closes b."},
+		{Position: "func New() *A {", Comment: "New returns an A."},
+	}
+	for _, noReformat := range []bool{false, true} {
+		opts := Options{Fields: true, GodocStyle: true, PackageComment: true, NoReformat: noReformat}
+		run := func(code string) AddResult {
+			result, err := AddComments(code, comments, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if noReformat {
+				// As in Generate.
+				result.Code = spliceComments(code, result.Applied, opts)
+			}
+			return result
+		}
+		first := run(src)
+		if len(first.Applied) != len(comments) {
+			t.Errorf("NoReformat %v: first run applied %d comments, want %d", noReformat, len(first.Applied), len(comments))
+		}
+		second := run(first.Code)
+		if second.Code != first.Code {
+			t.Errorf("NoReformat %v: second run =\n%s\nwant\n%s", noReformat, second.Code, first.Code)
+		}
+		if len(second.Applied) != 0 {
+			t.Errorf("NoReformat %v: second run applied %v", noReformat, second.Applied)
+		}
+	}
+}
+
+func TestAddCommentsGenerics(t *testing.T) {
+	src := "package p\n\nfunc Map[T, U any](s []T, f func(T) U) []U { return nil }\n\ntype List[T any] struct {\n\titems []T\n}\n\nfunc (l *List[T]) Len() int { return len(l.items) }\n"
+	want := "package p\n\n// Map applies f to each element of s.\nfunc Map[T, U any](s []T, f func(T) U) []U { return nil }\n\n// List is a list of any T.\ntype List[T any] struct {\n\titems []T\n}\n\n// Len returns the length of l.\nfunc (l *List[T]) Len() int { return len(l.items) }\n"
+	comments := []Comment{
+		{Position: "func Map[T, U any](s []T, f func(T) U) []U {", Comment: "Map applies f to each element of s."},
+		{Position: "type List[T any] struct {", Comment: "List is a list of any T."},
+		{Position: "func (l *List[T]) Len() int {", Comment: "Len returns the length of l."},
+	}
+	result, err := AddComments(src, comments, Options{GodocStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != want {
+		t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, want)
+	}
+	if len(result.Applied) != 3 || len(result.Unmatched) != 0 {
+		t.Errorf("AddComments() applied %v, unmatched %v", result.Applied, result.Unmatched)
+	}
+
+	// A second run finds everything documented.
+	again, err := AddComments(result.Code, comments, Options{GodocStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Code != want || len(again.Applied) != 0 {
+		t.Errorf("AddComments() on its output =\n%s\napplied %v", again.Code, again.Applied)
+	}
+}
+
+func TestAddCommentsKeepsComments(t *testing.T) {
+	src := `package p
+
+// Free-floating comment at the top.
+
+import "fmt" // for Println
+
+/*
+Block comment between declarations.
+*/
+
+// Documented has a doc comment.
+func Documented() {}
+
+func F() {
+	// Leading comment in the body.
+	fmt.Println("hi") // trailing comment in the body
+	/* inline */ fmt.Println()
+}
+
+type T struct {
+	// X has a field comment.
+	X int // trailing field comment
+	y int /* trailing block comment */
+}
+
+// Free-floating comment at the end.
+`
+	existing := []string{
+		"// Free-floating comment at the top.",
+		`import "fmt" // for Println`,
+		"/*\nBlock comment between declarations.\n*/",
+		"// Documented has a doc comment.",
+		"// Leading comment in the body.",
+		`fmt.Println("hi") // trailing comment in the body`,
+		"/* inline */ fmt.Println()",
+		"// X has a field comment.",
+		"X int // trailing field comment",
+		"y int /* trailing block comment */",
+		"// Free-floating comment at the end.",
+	}
+	comments := []Comment{
+		{Position: "func Documented() {", Comment: "Documented does nothing."},
+		{Position: "func F() {", Comment: "F prints."},
+		{Position: "type T struct {", Comment: "T holds X."},
+	}
+	for _, noReformat := range []bool{false, true} {
+		opts := Options{NoReformat: noReformat}
+		result, err := AddComments(src, comments, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := result.Code
+		if noReformat {
+			code = spliceComments(src, result.Applied, opts)
+		}
+		for _, c := range existing {
+			if strings.Count(code, c) != 1 {
+				t.Errorf("NoReformat %v: %q not kept once in\n%s", noReformat, c, code)
+			}
+		}
+		for _, c := range []string{"// F prints.\nfunc F() {", "// T holds X.\ntype T struct {"} {
+			if !strings.Contains(code, c) {
+				t.Errorf("NoReformat %v: %q not added to\n%s", noReformat, c, code)
+			}
+		}
+		if strings.Contains(code, "Documented does nothing.") {
+			t.Errorf("NoReformat %v: doc comment replaced in\n%s", noReformat, code)
+		}
+	}
+}
+
+func TestAddCommentsSameNamedMethods(t *testing.T) {
+	src := "package p\n\ntype A struct{}\n\ntype B struct{}\n\nfunc (a *A) Close() error { return nil }\n\nfunc (b B) Close() error { return nil }\n"
+	want := "package p\n\ntype A struct{}\n\ntype B struct{}\n\n// Close closes a.\nfunc (a *A) Close() error { return nil }\n\n// Close closes b.\nfunc (b B) Close() error { return nil }\n"
+	tests := []struct {
+		name     string
+		comments []Comment
+	}{
+		{"signatures", []Comment{
+			{Position: "func (a *A) Close() error {", Comment: "Close closes a."},
+			{Position: "func (b B) Close() error {", Comment: "Close closes b."},
+		}},
+		{"signatures in reverse order", []Comment{
+			{Position: "func (b B) Close() error {", Comment: "Close closes b."},
+			{Position: "func (a *A) Close() error {", Comment: "Close closes a."},
+		}},
+		{"receiver types only", []Comment{
+			{Position: "func (*B) Close()", Comment: "Close closes b."},
+			{Position: "func (A) Close()", Comment: "Close closes a."},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(src, tt.comments, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Code != want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, want)
+			}
+			if len(result.Applied) != 2 || len(result.Unmatched) != 0 {
+				t.Errorf("AddComments() applied %v, unmatched %v", result.Applied, result.Unmatched)
+			}
+		})
+	}
+}
+
+func TestAddCommentsDirectives(t *testing.T) {
+	comments := []Comment{
+		{Position: "type Kind int", Comment: "Kind is a kind."},
+		{Position: "var Hello string", Comment: "Hello is embedded."},
+		{Position: "func F() {", Comment: "F does nothing."},
+		{Position: "func G() {", Comment: "G does nothing."},
+	}
+	tests := []struct {
+		name string
+		src  string
+		opts Options
+		want string
+	}{
+		{
+			name: "directives",
+			src:  "package p\n\nimport _ \"embed\"\n\n//go:generate go run gen.go\n\n//go:generate stringer -type=Kind\ntype Kind int\n\n//go:embed hello.txt\nvar Hello string\n\n//nolint:errcheck\nfunc F() {}\n\nfunc G() {} //nolint:unused\n",
+			want: "package p\n\nimport _ \"embed\"\n\n//go:generate go run gen.go\n\n// Kind is a kind.\n//\n//go:generate stringer -type=Kind\ntype Kind int\n\n// Hello is embedded.\n//\n//go:embed hello.txt\nvar Hello string\n\n// F does nothing.\n//\n//nolint:errcheck\nfunc F() {}\n\n// G does nothing.\nfunc G() {} //nolint:unused\n",
+		},
+		{
+			name: "overwrite",
+			src:  "package p\n\n// F is old.\n//\n//nolint:errcheck\nfunc F() {}\n",
+			opts: Options{Overwrite: true},
+			want: "package p\n\n// F does nothing.\n//\n//nolint:errcheck\nfunc F() {}\n",
+		},
+		{
+			name: "documented",
+			src:  "package p\n\n// F is documented.\n//\n//nolint:errcheck\nfunc F() {}\n",
+			want: "package p\n\n// F is documented.\n//\n//nolint:errcheck\nfunc F() {}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(tt.src, comments, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+			if spliced := spliceComments(tt.src, result.Applied, tt.opts); spliced != tt.want {
+				t.Errorf("spliceComments() =\n%s\nwant\n%s", spliced, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapComment(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		width int
+		want  []string
+	}{
+		{"no wrap", "F does a lot of things.", 0, []string{"F does a lot of things."}},
+		{"ASCII", "F does a lot of things.", 14, []string{"F does a", "lot of", "things."}},
+		// By bytes each of these words would take 6 columns.
+		{"CJK words", "你好 世界 这是 注释", 10, []string{"你好 世界", "这是 注释"}},
+		{"long CJK run", "这是一个很长的没有空格的注释", 10, []string{"这是一个很长的没有空格的注释"}},
+		{"paragraphs", "F 做事。\n\n细节 在这里。", 9, []string{"F 做事。", "", "细节", "在这里。"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrapComment(tt.text, tt.width); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wrapComment() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCommentsMultibyte(t *testing.T) {
+	src := "package p\n\n// 问候语 is used by Hello.\nconst 问候语 = \"你好，世界\"\n\nfunc Hello() string { return 问候语 } // 返回问候\n\ntype 用户 struct {\n\t名字 string // 用户名\n}\n"
+	comments := []Comment{
+		{Position: "func Hello() string {", Comment: "Hello 返回一句中文问候语，用于测试多字节字符的处理。"},
+		{Position: "type 用户 struct {", Comment: "用户 描述一个用户。"},
+	}
+	want := "package p\n\n// 问候语 is used by Hello.\nconst 问候语 = \"你好，世界\"\n\n// Hello\n// 返回一句中文问候语，用于测试多字节字符的处理。\nfunc Hello() string { return 问候语 } // 返回问候\n\n// 用户 描述一个用户。\ntype 用户 struct {\n\t名字 string // 用户名\n}\n"
+	opts := Options{Wrap: 30}
+	result, err := AddComments(src, comments, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != want {
+		t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, want)
+	}
+	if spliced := spliceComments(src, result.Applied, opts); spliced != want {
+		t.Errorf("spliceComments() =\n%s\nwant\n%s", spliced, want)
+	}
+}
+
+func TestGodocComment(t *testing.T) {
+	tests := []struct {
+		text, name   string
+		allowArticle bool
+		want         string
+	}{
+		{"Hello returns a greeting.", "Hello", false, "Hello returns a greeting."},
+		{"Returns a greeting.", "Hello", false, "Hello returns a greeting."},
+		{"This function returns a greeting.", "Hello", false, "Hello returns a greeting."},
+		{"The type holds a rectangle.", "Rect", true, "Rect holds a rectangle."},
+		{"A Circle is a round shape.", "Circle", true, "A Circle is a round shape."},
+		{"The unit length.", "Unit", false, "Unit is the unit length."},
+		{"A helper that adds numbers.", "Add", false, "Add is a helper that adds numbers."},
+		{"A is a.", "A", false, "A is a."},
+		{"The is an article.", "The", false, "The is an article."},
+		{"HTTP server settings.", "Config", false, "Config HTTP server settings."},
+	}
+	for _, tt := range tests {
+		if got := godocComment(tt.text, tt.name, tt.allowArticle); got != tt.want {
+			t.Errorf("godocComment(%q, %q) = %q, want %q", tt.text, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package gocmt
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// explainMinComplexity is the cyclomatic complexity from which a function
+// gets an explanatory paragraph with Options.Explain, the limit commonly
+// used by gocyclo.
+const explainMinComplexity = 10
+
+// complexity returns the cyclomatic complexity of decl: one plus the number
+// of branches, i.e. if, for and range statements, non-default case and
+// select clauses, and && and || operators.
+func complexity(decl *ast.FuncDecl) int {
+	if decl.Body == nil {
+		return 1
+	}
+	n := 1
+	ast.Inspect(decl.Body, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			n++
+		case *ast.CaseClause:
+			if x.List != nil {
+				n++
+			}
+		case *ast.CommClause:
+			if x.Comm != nil {
+				n++
+			}
+		case *ast.BinaryExpr:
+			if x.Op == token.LAND || x.Op == token.LOR {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
+
+// explained reports whether decl gets an explanatory paragraph in addition
+// to its summary, see Options.Explain.
+func (o Options) explained(decl *ast.FuncDecl) bool {
+	return o.Explain && complexity(decl) >= explainMinComplexity
+}
+
+// explainedFuncs returns the keys, as in funcKey, of the functions and
+// methods of goCode in scope that get an explanatory paragraph.
+func explainedFuncs(goCode string, opts Options) ([]string, error) {
+	if !opts.Explain {
+		return nil, nil
+	}
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", goCode, 0)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, decl := range node.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || !opts.explained(fn) || !opts.includes(fn.Name.Name) || !opts.inLines(funcKey(fn)) {
+			continue
+		}
+		keys = append(keys, funcKey(fn))
+	}
+	return keys, nil
+}
@@ -0,0 +1,572 @@
+// Package gocmt adds doc comments to Go code using a large language model.
+//
+// The code is stripped down to its declarations, sent to the model, and the
+// comments it returns are inserted above the matching declarations:
+//
+//	client := gocmt.NewMoonShotClient("", os.Getenv("MOONSHOT_API_KEY"))
+//	result, err := gocmt.GenerateComments(ctx, src, gocmt.Options{Client: client})
+//
+// Options can also be set with functional options such as WithModel and
+// WithScope.
+package gocmt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// NewMoonShotClient creates a new MoonShot API client.
+func NewMoonShotClient(baseURL, authToken string) *openai.Client {
+	return NewMoonShotClientWithHTTPClient(baseURL, authToken, nil)
+}
+
+// NewMoonShotClientWithHTTPClient creates a new MoonShot API client that
+// sends its requests with httpClient, e.g. one going through a proxy. A nil
+// httpClient uses the default client. The client honors the Retry-After
+// header when an overloaded model is retried.
+func NewMoonShotClientWithHTTPClient(baseURL, authToken string, httpClient *http.Client) *openai.Client {
+	config := openai.DefaultConfig(authToken)
+	if len(baseURL) == 0 {
+		config.BaseURL = "https://api.moonshot.cn/v1"
+	} else {
+		config.BaseURL = baseURL
+	}
+	config.HTTPClient = withRetryAfterTransport(httpClient)
+	return openai.NewClientWithConfig(config)
+}
+
+// GenerateComments asks the model for comments on the Go source src and
+// returns the formatted source with the comments added. The extra options
+// are applied on top of opts.
+func GenerateComments(ctx context.Context, src string, opts Options, extra ...Option) (string, error) {
+	g, err := NewCommentGenerator(opts, extra...)
+	if err != nil {
+		return "", err
+	}
+	return g.GenerateComments(ctx, src)
+}
+
+// deterministicSeed is the seed sent in deterministic mode.
+const deterministicSeed = 42
+
+// streamUpdateInterval is the minimum time between two updates of the
+// streaming byte counter.
+const streamUpdateInterval = 200 * time.Millisecond
+
+// CommentGenerator asks the model for comments and applies them to Go code.
+// It is safe for concurrent use and accumulates the token usage of all its
+// requests.
+type CommentGenerator struct {
+	opts    Options
+	logger  Logger
+	limiter *rateLimiter
+
+	// promptTokens and completionTokens accumulate the token usage reported
+	// by the API across all requests.
+	promptTokens     atomic.Int64
+	completionTokens atomic.Int64
+}
+
+// NewCommentGenerator validates opts, with the extra options applied on
+// top, and returns a generator using them.
+func NewCommentGenerator(opts Options, extra ...Option) (*CommentGenerator, error) {
+	for _, o := range extra {
+		o(&opts)
+	}
+	if opts.Client == nil {
+		return nil, fmt.Errorf("no API client configured")
+	}
+	if opts.Model == "" {
+		opts.Model = DefaultModel
+	}
+	if opts.Language == "" {
+		opts.Language = "en"
+	}
+	if err := ValidateLanguage(opts.Language); err != nil {
+		return nil, err
+	}
+	if opts.Scope == "" {
+		opts.Scope = ScopeAll
+	}
+	if _, err := ParseScope(string(opts.Scope)); err != nil {
+		return nil, err
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	return &CommentGenerator{
+		opts:    opts,
+		logger:  logger,
+		limiter: newRateLimiter(opts.RequestsPerMinute),
+	}, nil
+}
+
+// GenerateComments asks the model for comments on goCode and returns the
+// formatted code with the comments added.
+func (g *CommentGenerator) GenerateComments(ctx context.Context, goCode string) (string, error) {
+	result, err := g.Generate(ctx, goCode)
+	return result.Code, err
+}
+
+// GenerateCommentsWithPackageComment is like GenerateComments, but also adds
+// a package comment if goCode has none, see Options.PackageComment. Use it
+// for the one file of each package that PackageCommentFiles picks.
+func (g *CommentGenerator) GenerateCommentsWithPackageComment(ctx context.Context, goCode string) (string, error) {
+	result, err := g.GenerateWithPackageComment(ctx, goCode)
+	return result.Code, err
+}
+
+// GenerateCommentsInLines is like GenerateComments, but only comments the
+// declarations overlapping lines of goCode, such as the lines changed in a
+// diff, instead of those of Options.Lines.
+func (g *CommentGenerator) GenerateCommentsInLines(ctx context.Context, goCode string, lines []LineRange) (string, error) {
+	result, err := g.GenerateInLines(ctx, goCode, lines)
+	return result.Code, err
+}
+
+// Generate is like GenerateComments, but also reports the comments applied,
+// those whose position matched no declaration, such as positions the model
+// made up, and the model and tokens used. The lines of the applied comments
+// refer to the code before the comments were added, formatted unless
+// Options.NoReformat is set.
+func (g *CommentGenerator) Generate(ctx context.Context, goCode string) (AddResult, error) {
+	return g.generateComments(ctx, goCode, g.opts)
+}
+
+// GenerateWithPackageComment is like Generate, but also adds a package
+// comment, see GenerateCommentsWithPackageComment.
+func (g *CommentGenerator) GenerateWithPackageComment(ctx context.Context, goCode string) (AddResult, error) {
+	opts := g.opts
+	opts.PackageComment = true
+	return g.generateComments(ctx, goCode, opts)
+}
+
+// GenerateInLines is like Generate, but only comments the declarations
+// overlapping lines of goCode, see GenerateCommentsInLines.
+func (g *CommentGenerator) GenerateInLines(ctx context.Context, goCode string, lines []LineRange) (AddResult, error) {
+	opts := g.opts
+	opts.Lines = lines
+	return g.generateComments(ctx, goCode, opts)
+}
+
+// generateComments implements Generate with opts, which differ from the
+// generator's options at most in the lines to comment and the package
+// comment.
+func (g *CommentGenerator) generateComments(ctx context.Context, goCode string, opts Options) (AddResult, error) {
+	// Work on LF line endings without a byte order mark, and write the
+	// result back the way the file was.
+	goCode, text := normalizeText(goCode)
+
+	// Format Go code, which also checks that it parses.
+	src := goCode
+	formatted, err := FormatGoCode(goCode)
+	if err != nil {
+		g.logger.Debugf("× Error format go code: %v", err)
+		return AddResult{}, err
+	}
+	// The line ranges refer to the code as given, not as formatted.
+	opts, err = opts.withLineDecls(src)
+	if err != nil {
+		return AddResult{}, err
+	}
+	if !opts.NoReformat {
+		goCode = formatted
+	}
+	// Ask for a package comment only if the file can get one.
+	opts.PackageComment, err = packageCommentWanted(goCode, opts)
+	if err != nil {
+		return AddResult{}, err
+	}
+
+	// Process Go code
+	g.logger.Debugf("Go code before process:\n%s", goCode)
+	decls, err := ProcessGoCode(goCode, opts)
+	if err != nil {
+		g.logger.Debugf("× Error processing Go code: %v", err)
+		return AddResult{}, err
+	}
+
+	opts.explainFuncs, err = explainedFuncs(goCode, opts)
+	if err != nil {
+		return AddResult{}, err
+	}
+
+	// The package clause and imports go with every chunk.
+	var preamble string
+	if opts.KeepImports {
+		preamble, err = fileContext(goCode)
+		if err != nil {
+			return AddResult{}, err
+		}
+	}
+
+	// Request comments chunk by chunk so that large files fit in the
+	// model's context window, then merge them for a single pass.
+	chunks := chunkDecls(decls, maxChunkTokens-estimateTokens(preamble))
+	var comments []Comment
+	var usage openai.Usage
+	var model string
+	for i, chunk := range chunks {
+		if preamble != "" {
+			chunk = preamble + "\n\n" + chunk
+		}
+		g.logger.Debugf("Go code after process (chunk %d/%d):\n%s", i+1, len(chunks), chunk)
+		resp, err := g.requestComments(ctx, chunk, opts)
+		if err != nil {
+			return AddResult{}, err
+		}
+		comments = append(comments, resp.comments...)
+		usage.PromptTokens += resp.usage.PromptTokens
+		usage.CompletionTokens += resp.usage.CompletionTokens
+		if model == "" || resp.model != opts.Model {
+			model = resp.model
+		}
+	}
+	comments, dropped := dedupeComments(comments)
+	for _, c := range dropped {
+		g.logger.Debugf("Dropped duplicate comment for position %q: %s", c.Position, c.Comment)
+	}
+
+	// Add the comments to the file.
+	result, err := AddComments(goCode, comments, opts)
+	if err != nil {
+		g.logger.Debugf("× Error adding comments to the file: %v", err)
+		return AddResult{}, err
+	}
+	for _, c := range result.Applied {
+		g.logger.Debugf("Added comment to %s (line %d): %s", c.Name, c.Line, c.Text)
+	}
+	for _, c := range result.Unmatched {
+		g.logger.Debugf("No declaration matches position %q", c.Position)
+	}
+	result.Model = model
+	result.PromptTokens = int64(usage.PromptTokens)
+	result.CompletionTokens = int64(usage.CompletionTokens)
+	if opts.NoReformat {
+		// Leave the code as it was apart from the new comments.
+		result.Code = text.restore(spliceComments(src, result.Applied, opts))
+		return result, nil
+	}
+
+	format := FormatGoCode
+	if opts.Format != nil {
+		format = opts.Format
+	}
+	formatResult, err := format(result.Code)
+	if err != nil {
+		g.logger.Debugf("× Error format go code: %v", err)
+		return AddResult{}, err
+	}
+	// Formatting adds a //go:build line next to a lone // +build line;
+	// keep the header exactly as the author wrote it.
+	code, err := preserveHeader(src, formatResult)
+	if err != nil {
+		return AddResult{}, err
+	}
+	result.Code = text.restore(code)
+	return result, nil
+}
+
+// Usage returns the prompt and completion tokens reported by the API across
+// all requests so far.
+func (g *CommentGenerator) Usage() (promptTokens, completionTokens int64) {
+	return g.promptTokens.Load(), g.completionTokens.Load()
+}
+
+// cacheKey returns the cache key for a request with the given model and
+// prompt.
+func cacheKey(model, prompt string) string {
+	sum := sha256.Sum256([]byte(model + "\x00" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheKey returns the cache key for a request to model with the given
+// prompt, see the package-level cacheKey.
+func (g *CommentGenerator) cacheKey(model, prompt string) string {
+	if g.opts.Structured {
+		// Structured responses are tool arguments, not message content.
+		model += "\x00structured"
+	}
+	return cacheKey(model, prompt)
+}
+
+// overloaded reports whether err is an API error saying that the model is
+// rate limited or temporarily unavailable.
+func overloaded(err error) bool {
+	var status int
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	if errors.As(err, &apiErr) {
+		status = apiErr.HTTPStatusCode
+	} else if errors.As(err, &reqErr) {
+		status = reqErr.HTTPStatusCode
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// describeAPIError adds the HTTP status and the error type reported by the
+// API to err, so that e.g. an authentication failure can be told apart from
+// a rate limit or an exceeded context length. The original error stays
+// available to errors.As.
+func describeAPIError(err error) error {
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		detail := "API error"
+		if apiErr.HTTPStatusCode > 0 {
+			detail += fmt.Sprintf(" (status %d %s", apiErr.HTTPStatusCode, http.StatusText(apiErr.HTTPStatusCode))
+			if apiErr.Type != "" {
+				detail += ", type " + apiErr.Type
+			}
+			detail += ")"
+		} else if apiErr.Type != "" {
+			detail += fmt.Sprintf(" (type %s)", apiErr.Type)
+		}
+		return &describedError{msg: detail + ": " + apiErr.Message, err: err}
+	case errors.As(err, &reqErr):
+		return &describedError{
+			msg: fmt.Sprintf("API request failed (status %d %s): %v", reqErr.HTTPStatusCode, http.StatusText(reqErr.HTTPStatusCode), reqErr.Err),
+			err: err,
+		}
+	}
+	return err
+}
+
+// describedError replaces the message of err, which it wraps.
+type describedError struct {
+	msg string
+	err error
+}
+
+func (e *describedError) Error() string { return e.msg }
+func (e *describedError) Unwrap() error { return e.err }
+
+// response is the answer of the model to a request for comments.
+type response struct {
+	comments []Comment
+	// model is the model that answered, which differs from Options.Model
+	// after a fallback.
+	model string
+	// usage is the token usage reported by the API, zero for cached and
+	// streamed responses.
+	usage openai.Usage
+}
+
+// requestComments asks the model for comments on the processed code.
+func (g *CommentGenerator) requestComments(ctx context.Context, processedCode string, opts Options) (response, error) {
+	prompt, err := buildPrompt(processedCode, opts)
+	if err != nil {
+		return response{}, err
+	}
+
+	// Fall back to the next model while the current one is overloaded. A
+	// fallback model's cached response is only used once the models before
+	// it have failed.
+	models := append([]string{g.opts.Model}, g.opts.FallbackModels...)
+	var commentsJSON, model string
+	var usage openai.Usage
+	for i := range models {
+		model = models[i]
+		if comments, ok := g.cachedComments(model, prompt); ok {
+			return response{comments: comments, model: model}, nil
+		}
+		commentsJSON, usage, err = g.completeRetrying(ctx, model, prompt)
+		if err == nil {
+			break
+		}
+		if i == len(models)-1 || !overloaded(err) {
+			return response{}, err
+		}
+		g.logger.Infof("» Model %s is overloaded, falling back to %s\n", model, models[i+1])
+	}
+	g.logger.Debugf("ChatCompletion result of model %s:\n%s\n", model, commentsJSON)
+	if model != g.opts.Model {
+		g.logger.Infof("» Generated the comments with fallback model %s\n", model)
+	}
+
+	// Process ChatCompletion result string
+	comments, err := g.parseComments(commentsJSON)
+	if err != nil {
+		g.logger.Debugf("× Error parsing ChatCompletion result: %v", err)
+		return response{}, err
+	}
+
+	if g.opts.Cache != nil {
+		if err := g.opts.Cache.Put(g.cacheKey(model, prompt.String()), commentsJSON); err != nil {
+			g.logger.Debugf("Failed to write cache: %v", err)
+		}
+	}
+	return response{comments: comments, model: model, usage: usage}, nil
+}
+
+// parseComments extracts the comments from the response content returned by
+// complete.
+func (g *CommentGenerator) parseComments(content string) ([]Comment, error) {
+	if g.opts.Structured {
+		return decodeComments(content)
+	}
+	return parseComments(content)
+}
+
+// cachedComments returns the cached comments of model for prompt, if any.
+func (g *CommentGenerator) cachedComments(model string, prompt chatPrompt) ([]Comment, bool) {
+	if g.opts.Cache == nil {
+		return nil, false
+	}
+	key := g.cacheKey(model, prompt.String())
+	content, ok := g.opts.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	g.logger.Debugf("Using cached ChatCompletion result %s:\n%s\n", key, content)
+	comments, err := g.parseComments(content)
+	if err != nil {
+		return nil, false
+	}
+	return comments, true
+}
+
+// completeRetrying is complete, retried up to overloadRetries times while
+// model is overloaded. It waits as long as the Retry-After header of the
+// response asks, or else backs off exponentially from overloadBackoff.
+func (g *CommentGenerator) completeRetrying(ctx context.Context, model string, prompt chatPrompt) (string, openai.Usage, error) {
+	backoff := overloadBackoff
+	for attempt := 0; ; attempt++ {
+		reqCtx, ra := withRetryAfter(ctx)
+		content, usage, err := g.complete(reqCtx, model, prompt)
+		if err == nil || attempt == overloadRetries || !overloaded(err) {
+			return content, usage, err
+		}
+		delay, ok := ra.get()
+		if !ok {
+			delay = backoff
+		}
+		g.logger.Infof("» Model %s is overloaded, retrying in %s\n", model, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return "", openai.Usage{}, err
+		}
+		backoff *= 2
+	}
+}
+
+// complete sends the prompt to model and returns the response content, or
+// the arguments of the comments tool call in structured mode, and the token
+// usage.
+func (g *CommentGenerator) complete(ctx context.Context, model string, prompt chatPrompt) (string, openai.Usage, error) {
+	// Wait for the rate limit before starting the timeout, which only
+	// bounds the request itself.
+	if err := g.limiter.wait(ctx); err != nil {
+		return "", openai.Usage{}, err
+	}
+
+	// Perform API request and get comments
+	if g.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.opts.Timeout)
+		defer cancel()
+	}
+	req := openai.ChatCompletionRequest{
+		Model:       model,
+		Temperature: g.opts.Temperature,
+		MaxTokens:   4096,
+		Messages:    prompt.messages(),
+	}
+	if g.opts.Deterministic {
+		// A zero temperature is left out of the request, which means the
+		// provider's default, so send the smallest positive one instead.
+		req.Temperature = math.SmallestNonzeroFloat32
+		seed := deterministicSeed
+		req.Seed = &seed
+	}
+	if g.opts.Structured {
+		useCommentsTool(&req)
+	}
+	if g.opts.Stream {
+		content, err := g.completeStream(ctx, req)
+		if err != nil {
+			err = describeAPIError(err)
+			g.logger.Debugf("ChatCompletionStream error: %v", err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				return "", openai.Usage{}, fmt.Errorf("request timed out after %s", g.opts.Timeout)
+			}
+			return "", openai.Usage{}, err
+		}
+		return content, openai.Usage{}, nil
+	}
+
+	resp, err := g.opts.Client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		err = describeAPIError(err)
+		g.logger.Debugf("ChatCompletion error: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", openai.Usage{}, fmt.Errorf("request timed out after %s", g.opts.Timeout)
+		}
+		return "", openai.Usage{}, err
+	}
+	g.promptTokens.Add(int64(resp.Usage.PromptTokens))
+	g.completionTokens.Add(int64(resp.Usage.CompletionTokens))
+	if len(resp.Choices) == 0 {
+		return "", resp.Usage, fmt.Errorf("model returned no choices")
+	}
+	if g.opts.Structured {
+		content, err := toolArguments(resp.Choices[0].Message)
+		return content, resp.Usage, err
+	}
+	return resp.Choices[0].Message.Content, resp.Usage, nil
+}
+
+// completeStream sends the request using the streaming API and returns the
+// accumulated content, reporting the number of bytes received as it arrives.
+// The API doesn't report token usage for streamed responses.
+func (g *CommentGenerator) completeStream(ctx context.Context, req openai.ChatCompletionRequest) (string, error) {
+	stream, err := g.opts.Client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	var lastUpdate time.Time
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, choice := range resp.Choices {
+			if !g.opts.Structured {
+				content.WriteString(choice.Delta.Content)
+				continue
+			}
+			// The tool call arguments arrive in pieces as well.
+			for _, call := range choice.Delta.ToolCalls {
+				content.WriteString(call.Function.Arguments)
+			}
+		}
+		if time.Since(lastUpdate) >= streamUpdateInterval {
+			lastUpdate = time.Now()
+			g.logger.Infof("\r» Streaming response: %d bytes received", content.Len())
+		}
+	}
+	g.logger.Infof("\r» Streaming response: %d bytes received\n", content.Len())
+	return content.String(), nil
+}
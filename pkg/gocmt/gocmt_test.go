@@ -0,0 +1,388 @@
+package gocmt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeClient is a ChatClient answering every request with content, for
+// running the pipeline offline.
+type fakeClient struct {
+	content string
+	err     error
+	// modelErrs are returned instead of content for requests to a model,
+	// with retryAfter recorded as the Retry-After header.
+	modelErrs  map[string]error
+	retryAfter time.Duration
+
+	mu       sync.Mutex
+	requests []openai.ChatCompletionRequest
+}
+
+func (c *fakeClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.mu.Unlock()
+	if c.err != nil {
+		return openai.ChatCompletionResponse{}, c.err
+	}
+	if err := c.modelErrs[req.Model]; err != nil {
+		if c.retryAfter > 0 {
+			setRetryAfter(ctx, c.retryAfter)
+		}
+		return openai.ChatCompletionResponse{}, err
+	}
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: c.content},
+		}},
+		Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5},
+	}, nil
+}
+
+func (c *fakeClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
+	return nil, errors.New("streaming is not supported by the fake client")
+}
+
+// commentsResponse returns a model response commenting the positions, given
+// as position and comment pairs.
+func commentsResponse(pairs ...string) string {
+	var sb strings.Builder
+	sb.WriteString(`{"comments": [`)
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`{"position": ` + quote(pairs[i]) + `, "comment": ` + quote(pairs[i+1]) + `}`)
+	}
+	sb.WriteString(`]}`)
+	return sb.String()
+}
+
+// quote returns s as a JSON string.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		response  string
+		want      string
+		applied   int
+		unmatched int
+		wantErr   string
+	}{
+		{
+			name:     "comment added",
+			src:      "package p\n\nfunc Hello() string {\n\treturn \"hi\"\n}\n",
+			response: commentsResponse("func Hello() string {", "Hello returns a greeting."),
+			want:     "package p\n\n// Hello returns a greeting.\nfunc Hello() string {\n\treturn \"hi\"\n}\n",
+			applied:  1,
+		},
+		{
+			name: "fenced response",
+			src:  "package p\n\ntype T int\n",
+			response: "Here are the comments:\n```json\n" +
+				commentsResponse("type T int", "T is a number.") + "\n```\n",
+			want:    "package p\n\n// T is a number.\ntype T int\n",
+			applied: 1,
+		},
+		{
+			name:     "malformed response",
+			src:      "package p\n\nfunc Hello() {}\n",
+			response: `{"comments": [{"position": "func Hello() {", "comment": `,
+			wantErr:  "no valid comments JSON",
+		},
+		{
+			name:     "already commented",
+			src:      "package p\n\n// Hello says hello.\nfunc Hello() {}\n",
+			response: commentsResponse("func Hello() {", "Hello greets."),
+			want:     "package p\n\n// Hello says hello.\nfunc Hello() {}\n",
+		},
+		{
+			name:      "unknown position",
+			src:       "package p\n\nfunc Hello() {}\n",
+			response:  commentsResponse("func Missing() {", "Missing is made up."),
+			want:      "package p\n\nfunc Hello() {}\n",
+			unmatched: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{content: tt.response}
+			g, err := NewCommentGenerator(Options{Client: client, GodocStyle: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := g.Generate(context.Background(), tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Generate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("Generate() code =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+			if len(result.Applied) != tt.applied {
+				t.Errorf("Generate() applied %d comments, want %d", len(result.Applied), tt.applied)
+			}
+			if len(result.Unmatched) != tt.unmatched {
+				t.Errorf("Generate() unmatched %d comments, want %d", len(result.Unmatched), tt.unmatched)
+			}
+			if result.PromptTokens != 10 || result.CompletionTokens != 5 {
+				t.Errorf("Generate() tokens = %d+%d, want 10+5", result.PromptTokens, result.CompletionTokens)
+			}
+			if prompt, completion := g.Usage(); prompt != 10 || completion != 5 {
+				t.Errorf("Usage() = %d+%d, want 10+5", prompt, completion)
+			}
+			if len(client.requests) != 1 {
+				t.Errorf("Generate() sent %d requests, want 1", len(client.requests))
+			}
+		})
+	}
+}
+
+func TestGenerateAPIError(t *testing.T) {
+	client := &fakeClient{err: errors.New("connection refused")}
+	g, err := NewCommentGenerator(Options{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.GenerateComments(context.Background(), "package p\n\nfunc F() {}\n"); err == nil {
+		t.Fatal("GenerateComments() succeeded with a failing client")
+	}
+}
+
+func TestNewCommentGeneratorNoClient(t *testing.T) {
+	if _, err := NewCommentGenerator(Options{}); err == nil {
+		t.Fatal("NewCommentGenerator() succeeded without a client")
+	}
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	client := &fakeClient{content: commentsResponse()}
+	g, err := NewCommentGenerator(Options{Client: client, Temperature: 0.7, Deterministic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Generate(context.Background(), "package p\n\nfunc F() {}\n"); err != nil {
+		t.Fatal(err)
+	}
+	req := client.requests[0]
+	if req.Temperature <= 0 || req.Temperature > 1e-30 {
+		t.Errorf("temperature = %g, want the smallest positive one", req.Temperature)
+	}
+	if req.Seed == nil || *req.Seed != deterministicSeed {
+		t.Errorf("seed = %v, want %d", req.Seed, deterministicSeed)
+	}
+}
+
+// recordingLogger is a Logger keeping the debug messages.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {}
+
+func TestGenerateDuplicateComments(t *testing.T) {
+	src := "package p\n\nfunc F() {}\n\nfunc G() {}\n"
+	response := commentsResponse(
+		"func F() {", "F does nothing.",
+		"func G() {", "G does nothing.",
+		"func F()", "F does something else.",
+		"func  F() {", "F does a third thing.",
+	)
+	logger := &recordingLogger{}
+	g, err := NewCommentGenerator(Options{Client: &fakeClient{content: response}, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := g.Generate(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\n// F does nothing.\nfunc F() {}\n\n// G does nothing.\nfunc G() {}\n"
+	if result.Code != want {
+		t.Errorf("Generate() =\n%s\nwant\n%s", result.Code, want)
+	}
+	if len(result.Applied) != 2 || len(result.Unmatched) != 0 {
+		t.Errorf("Generate() applied %v, unmatched %v", result.Applied, result.Unmatched)
+	}
+	var dropped int
+	for _, msg := range logger.messages {
+		if strings.HasPrefix(msg, "Dropped duplicate comment") {
+			dropped++
+		}
+	}
+	if dropped != 2 {
+		t.Errorf("logged %d dropped duplicates, want 2:\n%s", dropped, strings.Join(logger.messages, "\n"))
+	}
+}
+
+// memoryCache is a Cache kept in memory.
+type memoryCache map[string]string
+
+func (c memoryCache) Get(key string) (string, bool) {
+	content, ok := c[key]
+	return content, ok
+}
+
+func (c memoryCache) Put(key, content string) error {
+	c[key] = content
+	return nil
+}
+
+func TestGenerateFallbackModels(t *testing.T) {
+	defer func(backoff time.Duration) { overloadBackoff = backoff }(overloadBackoff)
+	overloadBackoff = time.Millisecond
+
+	src := "package p\n\nfunc Hello() {}\n"
+	tooManyRequests := &openai.APIError{HTTPStatusCode: 429, Message: "rate limited"}
+	tests := []struct {
+		name       string
+		modelErrs  map[string]error
+		retryAfter time.Duration
+		wantModels []string
+		wantErr    bool
+	}{
+		{
+			name:       "available",
+			wantModels: []string{"primary"},
+		},
+		{
+			name:       "overloaded",
+			modelErrs:  map[string]error{"primary": tooManyRequests},
+			wantModels: []string{"primary", "primary", "primary", "backup"},
+		},
+		{
+			name:       "retry after",
+			modelErrs:  map[string]error{"primary": tooManyRequests},
+			retryAfter: 10 * time.Millisecond,
+			wantModels: []string{"primary", "primary", "primary", "backup"},
+		},
+		{
+			name:       "unauthorized",
+			modelErrs:  map[string]error{"primary": &openai.APIError{HTTPStatusCode: 401, Message: "invalid key"}},
+			wantModels: []string{"primary"},
+			wantErr:    true,
+		},
+		{
+			name:       "all overloaded",
+			modelErrs:  map[string]error{"primary": tooManyRequests, "backup": tooManyRequests},
+			wantModels: []string{"primary", "primary", "primary", "backup", "backup", "backup"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{content: commentsResponse("func Hello() {", "Hello says hello."), modelErrs: tt.modelErrs, retryAfter: tt.retryAfter}
+			g, err := NewCommentGenerator(Options{Client: client, Model: "primary", FallbackModels: []string{"backup"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			result, err := g.Generate(context.Background(), src)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Generate() = %q, want an error", result.Code)
+				}
+			} else if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			} else if len(result.Applied) != 1 {
+				t.Errorf("Generate() applied %d comments, want 1", len(result.Applied))
+			}
+			var models []string
+			for _, req := range client.requests {
+				models = append(models, req.Model)
+			}
+			if strings.Join(models, ",") != strings.Join(tt.wantModels, ",") {
+				t.Errorf("Generate() requested models %v, want %v", models, tt.wantModels)
+			}
+			if elapsed := time.Since(start); elapsed < 2*tt.retryAfter {
+				t.Errorf("Generate() took %s, want at least %s for two retries", elapsed, 2*tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestGenerateFallbackCache(t *testing.T) {
+	defer func(backoff time.Duration) { overloadBackoff = backoff }(overloadBackoff)
+	overloadBackoff = time.Millisecond
+
+	src := "package p\n\nfunc Hello() {}\n"
+	// Cache a response of the fallback model.
+	backupCache := memoryCache{}
+	backup := &fakeClient{content: commentsResponse("func Hello() {", "Hello is from the backup model.")}
+	g, err := NewCommentGenerator(Options{Client: backup, Model: "backup", Cache: backupCache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Generate(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		modelErrs map[string]error
+		want      string
+		requests  int
+	}{
+		{
+			name:     "primary available",
+			want:     "Hello is from the primary model.",
+			requests: 1,
+		},
+		{
+			name:      "primary overloaded",
+			modelErrs: map[string]error{"primary": &openai.APIError{HTTPStatusCode: 503, Message: "unavailable"}},
+			want:      "Hello is from the backup model.",
+			requests:  1 + overloadRetries,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := memoryCache{}
+			for key, content := range backupCache {
+				cache[key] = content
+			}
+			client := &fakeClient{content: commentsResponse("func Hello() {", "Hello is from the primary model."), modelErrs: tt.modelErrs}
+			g, err := NewCommentGenerator(Options{Client: client, Model: "primary", FallbackModels: []string{"backup"}, Cache: cache})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := g.Generate(context.Background(), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(result.Code, tt.want) {
+				t.Errorf("Generate() =\n%s\nwant %q", result.Code, tt.want)
+			}
+			if len(client.requests) != tt.requests {
+				t.Errorf("Generate() sent %d requests, want %d", len(client.requests), tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package gocmt
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// fileHeader returns the part of the Go source src before the package doc
+// comment, or before the package clause if there is none. This is where
+// build constraints such as //go:build and // +build lines and license
+// headers live, which must stay at the very top of the file. A build
+// constraint directly above the package clause, which the parser takes for
+// the package doc comment, belongs to the header too.
+func fileHeader(src string) (string, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	end := node.Package
+	if node.Doc != nil && strings.TrimSpace(node.Doc.Text()) != "" {
+		end = node.Doc.Pos()
+	}
+	return src[:fset.Position(end).Offset], nil
+}
+
+// preserveHeader makes sure that result, the rewritten form of src, starts
+// with the same header as src, see fileHeader. Printing the AST keeps the
+// header in place, so this only guards against the header being reordered
+// or absorbed by comments inserted near the top of the file.
+func preserveHeader(src, result string) (string, error) {
+	header, err := fileHeader(src)
+	if err != nil {
+		return "", err
+	}
+	resultHeader, err := fileHeader(result)
+	if err != nil {
+		return "", err
+	}
+	// The printer separates a build constraint from the package clause
+	// with a blank line, which is no change to the header.
+	if strings.TrimSpace(header) == strings.TrimSpace(resultHeader) {
+		return result, nil
+	}
+	return header + result[len(resultHeader):], nil
+}
@@ -0,0 +1,84 @@
+package gocmt
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAddCommentsHeader(t *testing.T) {
+	comments := []Comment{
+		{Position: "package p", Comment: "Package p provides F."},
+		{Position: "func F() {", Comment: "F does nothing."},
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+		// reformatted and spliced are the output of Generate with and
+		// without reformatting, if it isn't want.
+		reformatted, spliced string
+	}{
+		{
+			name: "build constraint above the package clause",
+			src:  "//go:build linux\npackage p\n\nfunc F() {}\n",
+			want: "//go:build linux\n\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+			// Formatting the code first makes room for a package comment.
+			reformatted: "//go:build linux\n\n// Package p provides F.\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+			spliced:     "//go:build linux\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name: "build constraints",
+			src:  "//go:build linux && amd64\n// +build linux,amd64\n\npackage p\n\nfunc F() {}\n",
+			want: "//go:build linux && amd64\n// +build linux,amd64\n\n// Package p provides F.\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name: "SPDX header and build constraint",
+			src:  "// SPDX-License-Identifier: Apache-2.0\n// Copyright 2024 The Authors.\n\n//go:build !windows\n\npackage p\n\nfunc F() {}\n",
+			want: "// SPDX-License-Identifier: Apache-2.0\n// Copyright 2024 The Authors.\n\n//go:build !windows\n\n// Package p provides F.\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name: "block license header",
+			src:  "/*\nCopyright 2024 The Authors.\n\nLicensed under the MIT License.\n*/\n\npackage p\n\nfunc F() {}\n",
+			want: "/*\nCopyright 2024 The Authors.\n\nLicensed under the MIT License.\n*/\n\n// Package p provides F.\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name: "existing package comment",
+			src:  "// SPDX-License-Identifier: MIT\n\n// Package p is documented.\npackage p\n\nfunc F() {}\n",
+			want: "// SPDX-License-Identifier: MIT\n\n// Package p is documented.\npackage p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(tt.src, comments, Options{PackageComment: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+
+			// Through the generator, with and without reformatting.
+			for _, noReformat := range []bool{false, true} {
+				client := &fakeClient{content: commentsResponse("package p", "Package p provides F.", "func F() {", "F does nothing.")}
+				g, err := NewCommentGenerator(Options{Client: client, NoReformat: noReformat})
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, err := g.GenerateWithPackageComment(context.Background(), tt.src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tt.want
+				if !noReformat && tt.reformatted != "" {
+					want = tt.reformatted
+				}
+				if noReformat && tt.spliced != "" {
+					want = tt.spliced
+				}
+				if result.Code != want {
+					t.Errorf("GenerateWithPackageComment(NoReformat: %v) =\n%s\nwant\n%s", noReformat, result.Code, want)
+				}
+			}
+		})
+	}
+}
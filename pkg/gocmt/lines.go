@@ -0,0 +1,111 @@
+package gocmt
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// withLineDecls returns o with the declarations overlapping o.Lines in the
+// Go source src looked up, unless there are no line ranges or that is done
+// already. Looking them up once, on the source the ranges refer to, keeps
+// them valid when the code is reformatted and lines move.
+func (o Options) withLineDecls(src string) (Options, error) {
+	if o.Lines == nil || o.lineDecls != nil {
+		return o, nil
+	}
+	decls, err := declsInLines(src, o.Lines)
+	if err != nil {
+		return o, err
+	}
+	o.lineDecls = decls
+	return o, nil
+}
+
+// inLines reports whether the declaration with the given key, as used in
+// AppliedComment.Name, overlaps the line ranges of o.Lines, if any.
+func (o Options) inLines(key string) bool {
+	return o.Lines == nil || o.lineDecls[key]
+}
+
+// declsInLines returns the keys of the declarations in src that overlap
+// lines, including their doc comments: functions, methods, types, the
+// fields and methods of struct and interface types, and variables and
+// constants by their first name. A type overlaps the lines of its changed
+// members as well.
+func declsInLines(src string, lines []LineRange) (map[string]bool, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Go code: %v", err)
+	}
+
+	overlaps := func(doc *ast.CommentGroup, n ast.Node) bool {
+		start := n.Pos()
+		if doc != nil {
+			start = doc.Pos()
+		}
+		first, last := fset.Position(start).Line, fset.Position(n.End()).Line
+		for _, r := range lines {
+			if r.Start <= last && r.End >= first {
+				return true
+			}
+		}
+		return false
+	}
+	members := func(typeName string, list *ast.FieldList, decls map[string]bool) {
+		for _, field := range list.List {
+			if overlaps(field.Doc, field) {
+				decls[typeName+"."+fieldName(field)] = true
+			}
+		}
+	}
+
+	decls := make(map[string]bool)
+	for _, decl := range node.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if overlaps(d.Doc, d) {
+				decls[funcKey(d)] = true
+			}
+		case *ast.GenDecl:
+			if d.Tok == token.VAR || d.Tok == token.CONST {
+				for _, spec := range d.Specs {
+					vs := spec.(*ast.ValueSpec)
+					doc := vs.Doc
+					var n ast.Node = vs
+					if !d.Lparen.IsValid() {
+						doc, n = d.Doc, d
+					}
+					if overlaps(doc, n) {
+						decls[vs.Names[0].Name] = true
+					}
+				}
+				continue
+			}
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				var n ast.Node = ts
+				if !d.Lparen.IsValid() {
+					doc, n = d.Doc, d
+				}
+				if !overlaps(doc, n) {
+					continue
+				}
+				decls[ts.Name.Name] = true
+				switch t := ts.Type.(type) {
+				case *ast.StructType:
+					members(ts.Name.Name, t.Fields, decls)
+				case *ast.InterfaceType:
+					members(ts.Name.Name, t.Methods, decls)
+				}
+			}
+		}
+	}
+	return decls, nil
+}
@@ -0,0 +1,261 @@
+package gocmt
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"regexp"
+	"text/template"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// DefaultModel is the model used when Options.Model is empty.
+const DefaultModel = "moonshot-v1-8k"
+
+// Scope selects which declarations get comments, by visibility.
+type Scope string
+
+// The supported scopes: all declarations, exported ones only, or unexported
+// ones only.
+const (
+	ScopeAll        Scope = "all"
+	ScopeExported   Scope = "exported"
+	ScopeUnexported Scope = "unexported"
+)
+
+// ParseScope validates a scope name.
+func ParseScope(s string) (Scope, error) {
+	switch scope := Scope(s); scope {
+	case ScopeAll, ScopeExported, ScopeUnexported:
+		return scope, nil
+	}
+	return "", fmt.Errorf("invalid scope %q, must be one of: all, exported, unexported", s)
+}
+
+// CommentStyle selects how multi-line comments are written.
+type CommentStyle string
+
+// The supported comment styles: "//" on every line, or a single /* */ block
+// for comments of more than one line.
+const (
+	StyleLine  CommentStyle = "line"
+	StyleBlock CommentStyle = "block"
+)
+
+// ParseCommentStyle validates a comment style name.
+func ParseCommentStyle(s string) (CommentStyle, error) {
+	switch style := CommentStyle(s); style {
+	case StyleLine, StyleBlock:
+		return style, nil
+	}
+	return "", fmt.Errorf("invalid comment style %q, must be one of: line, block", s)
+}
+
+// LineRange is a range of lines from Start to End inclusive, counting from
+// 1.
+type LineRange struct {
+	Start, End int
+}
+
+// Logger receives the diagnostic and progress messages of a
+// CommentGenerator.
+type Logger interface {
+	// Debugf logs a diagnostic message, such as the prompt or the raw
+	// model response.
+	Debugf(format string, args ...interface{})
+	// Infof reports progress, such as the bytes received while streaming.
+	Infof(format string, args ...interface{})
+}
+
+// ChatClient is the part of the OpenAI-compatible API client used to
+// request comments. *openai.Client implements it, and tests can substitute a
+// fake returning canned responses to run the pipeline offline.
+type ChatClient interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error)
+}
+
+var _ ChatClient = (*openai.Client)(nil)
+
+// Cache stores model responses so that unchanged code doesn't trigger
+// another API call. Keys are derived from the model and the prompt.
+type Cache interface {
+	Get(key string) (string, bool)
+	Put(key, content string) error
+}
+
+// Options configures how comments are generated and applied to the code.
+type Options struct {
+	// Client is the API client used to request comments. It is required to
+	// generate comments but unused by AddComments and ProcessGoCode.
+	Client ChatClient
+	// Model is the model used to generate comments, DefaultModel if empty.
+	Model string
+	// FallbackModels are tried in order when the previous model is
+	// overloaded, i.e. responds with 429 Too Many Requests or a 502, 503 or
+	// 504 status, even after retrying with backoff.
+	FallbackModels []string
+	Temperature    float32
+	// Deterministic ignores Temperature and samples with a fixed seed and the
+	// smallest positive temperature, math.SmallestNonzeroFloat32, which
+	// behaves like 0 while a 0 would be left out of the request and mean the
+	// provider's default, so that the same code gets the same comments as
+	// far as the provider allows. Output stays best-effort stable: OpenAI
+	// and Ollama honor the seed, other providers such as Moonshot ignore it.
+	Deterministic bool
+	// Language is the code of the language comments are written in, e.g.
+	// "en" or "zh". Empty means English.
+	Language string
+	// PromptTemplate is a custom prompt template for the user message, nil
+	// for the built-in prompt. See LoadPromptTemplate.
+	PromptTemplate *template.Template
+	// SystemPromptTemplate is a custom system message, nil for the built-in
+	// instructions. See LoadSystemPromptTemplate.
+	SystemPromptTemplate *template.Template
+	// NoSystemPrompt sends the instructions and the code in a single user
+	// message instead of putting the instructions in a system message.
+	NoSystemPrompt bool
+	// Timeout bounds each request to the model; zero means no timeout.
+	Timeout time.Duration
+	// RequestsPerMinute limits the requests started per minute across all
+	// concurrent calls of a CommentGenerator; zero means no limit.
+	RequestsPerMinute int
+	// Stream uses the streaming API and reports bytes as they arrive.
+	Stream bool
+	// Structured has the model return the comments as the arguments of a
+	// tool call instead of JSON in the message text. Not all providers and
+	// models support tools.
+	Structured bool
+	// Cache stores model responses, nil disables caching.
+	Cache Cache
+	// Logger receives diagnostic messages, nil discards them.
+	Logger Logger
+
+	// Format, if set, formats the code with the comments added instead of
+	// FormatGoCode, e.g. to apply a stricter formatter such as gofumpt.
+	Format func(code string) (string, error)
+	// NoReformat inserts the comments into the code as it is, instead of
+	// returning the code formatted like gofmt, so that unrelated lines stay
+	// untouched.
+	NoReformat bool
+	// Wrap is the column at which comment lines are wrapped, zero disables
+	// wrapping.
+	Wrap int
+	// Style selects line or block comments for comments of more than one
+	// line. Empty means line comments.
+	Style CommentStyle
+	// GodocStyle makes each comment start with the name of the declaration
+	// it describes, as go/doc and linters expect.
+	GodocStyle bool
+	// Approve, if set, is called for each comment before it is added and
+	// returns the text to add, or false to drop the comment.
+	Approve func(p Proposal) (string, bool)
+	// PackageComment asks for a package comment if the file has none,
+	// which it then gets unless anything is directly above its package
+	// clause. Only one file of a package should have one, so this is
+	// meant to be set per file with GenerateCommentsWithPackageComment,
+	// for the file PackageCommentFiles picks. It has no effect with
+	// Lines, an unexported Scope or Match.
+	PackageComment bool
+	// Fields also comments the exported fields of structs that have no
+	// comment yet, at the cost of more tokens.
+	Fields bool
+	// KeepImports sends the package clause and the imports along with the
+	// code, so that comments can refer to the dependencies used.
+	KeepImports bool
+	// KeepBodies sends function bodies instead of stripping them, for
+	// comments that describe what the code does, at the cost of many more
+	// tokens.
+	KeepBodies bool
+	// MaxComments, if positive, limits the comments added per file. The
+	// model is asked to focus on the most important declarations, and the
+	// comments of exported declarations are kept first, then those that
+	// come first in the source.
+	MaxComments int
+	// Explain asks for a short paragraph on how and why after the summary
+	// of complex functions, whose bodies are sent along for it, at the cost
+	// of more tokens.
+	Explain bool
+	// Overwrite replaces existing doc comments instead of skipping them.
+	Overwrite bool
+	// Scope limits comments to exported or unexported declarations. Empty
+	// means all declarations.
+	Scope Scope
+	// Match, if set, limits comments to declarations whose name it
+	// matches. Methods are matched by their name without the receiver.
+	Match *regexp.Regexp
+	// Lines, if not nil, limits comments to declarations overlapping these
+	// lines of the source, such as the lines changed in a diff.
+	Lines []LineRange
+
+	// lineDecls are the declarations overlapping Lines, see withLineDecls.
+	lineDecls map[string]bool
+	// explainFuncs are the functions explained, see explainedFuncs.
+	explainFuncs []string
+}
+
+// Option sets a field of Options. The options passed to
+// NewCommentGenerator and GenerateComments are applied in order on top of
+// the Options given, so that callers only spell out what they change:
+//
+//	g, err := gocmt.NewCommentGenerator(gocmt.Options{Client: client},
+//		gocmt.WithModel("moonshot-v1-32k"), gocmt.WithScope(gocmt.ScopeExported))
+type Option func(*Options)
+
+// WithClient sets Options.Client.
+func WithClient(client ChatClient) Option {
+	return func(o *Options) { o.Client = client }
+}
+
+// WithModel sets Options.Model.
+func WithModel(model string) Option {
+	return func(o *Options) { o.Model = model }
+}
+
+// WithTemperature sets Options.Temperature.
+func WithTemperature(temperature float32) Option {
+	return func(o *Options) { o.Temperature = temperature }
+}
+
+// WithLanguage sets Options.Language.
+func WithLanguage(lang string) Option {
+	return func(o *Options) { o.Language = lang }
+}
+
+// WithScope sets Options.Scope.
+func WithScope(scope Scope) Option {
+	return func(o *Options) { o.Scope = scope }
+}
+
+// WithWrap sets Options.Wrap.
+func WithWrap(column int) Option {
+	return func(o *Options) { o.Wrap = column }
+}
+
+// WithLogger sets Options.Logger.
+func WithLogger(logger Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// includes reports whether the declaration with the given name should get
+// a comment.
+func (o Options) includes(name string) bool {
+	if o.Match != nil && !o.Match.MatchString(name) {
+		return false
+	}
+	switch o.Scope {
+	case ScopeExported:
+		return ast.IsExported(name)
+	case ScopeUnexported:
+		return !ast.IsExported(name)
+	}
+	return true
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
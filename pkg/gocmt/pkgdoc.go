@@ -0,0 +1,198 @@
+package gocmt
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// packageCommentRequirement asks the model for a package comment, see
+// Options.PackageComment.
+const packageCommentRequirement = `- Also write a package comment, using the package clause as the position, e.g. "package server", starting with "Package server" and summarizing what the package provides as a whole.
+`
+
+var (
+	// positionPackageRe captures the name of a package clause position,
+	// e.g. "server" in "package server".
+	positionPackageRe = regexp.MustCompile(`^package\s+(` + identPattern + `)\s*$`)
+	// packageClauseRe matches an opening such as "This package" that
+	// refers to the package instead of naming it.
+	packageClauseRe = regexp.MustCompile(`^(?:[Tt]his|[Tt]he)\s+package\b[\s,:]*`)
+)
+
+// wantsPackageComment reports whether node gets a package comment according
+// to opts: Options.PackageComment is set, the file has no comment directly
+// above its package clause, which would be its package comment or a build
+// constraint that must stay in place, and the package is in scope. Package
+// comments are only added when commenting whole files, not lines.
+func (o Options) wantsPackageComment(node *ast.File) bool {
+	return o.PackageComment && node.Doc == nil && o.Lines == nil && o.Scope != ScopeUnexported && o.Match == nil
+}
+
+// packageCommentWanted is wantsPackageComment for the Go source src.
+func packageCommentWanted(src string, opts Options) (bool, error) {
+	if !opts.PackageComment {
+		return false, nil
+	}
+	node, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false, err
+	}
+	return opts.wantsPackageComment(node), nil
+}
+
+// packageCommentFor returns the package comment of node based on position,
+// marking the comment found in matched. An existing package comment is never
+// replaced. The printer can't place a comment added to the AST above the
+// package clause at the start of a file, so it is inserted as text with
+// insertPackageComment once the code is printed.
+func packageCommentFor(node *ast.File, comments []Comment, matched []bool, opts Options) (string, bool) {
+	i, ok := findPackageComment(node.Name.Name, comments)
+	if !ok {
+		return "", false
+	}
+	matched[i] = true
+	if !opts.wantsPackageComment(node) {
+		return "", false
+	}
+	text := comments[i].Comment
+	if opts.GodocStyle {
+		text = packageComment(text, node.Name.Name)
+	}
+	clause := "package " + node.Name.Name
+	return approve(opts, clause, clause, text)
+}
+
+// insertPackageComment inserts the package comment text above the package
+// clause of code.
+func insertPackageComment(code, text string, opts Options) (string, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", code, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	opts.Overwrite = false
+	return spliceComments(code, []AppliedComment{{Line: fset.Position(node.Package).Line, Text: text}}, opts), nil
+}
+
+// findPackageComment returns the index of the comment whose position is the
+// package clause of the package name.
+func findPackageComment(name string, comments []Comment) (int, bool) {
+	for i, comment := range comments {
+		m := positionPackageRe.FindStringSubmatch(strings.TrimSpace(comment.Position))
+		if m != nil && m[1] == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// packageComment rewrites text to start with "Package name", as go/doc and
+// linters expect of a package comment. A leading clause such as "This
+// package" is replaced.
+func packageComment(text, name string) string {
+	text = strings.TrimSpace(text)
+	prefix := "Package " + name
+	if text == prefix || strings.HasPrefix(text, prefix+" ") {
+		return text
+	}
+	if strings.HasPrefix(text, name+" ") {
+		return "Package " + text
+	}
+	text = packageClauseRe.ReplaceAllString(text, "")
+	return ensureNamePrefix(text, prefix)
+}
+
+// packageID identifies a package by its directory and name, since a
+// directory may also hold files of another package, such as a main package
+// excluded by build constraints.
+type packageID struct {
+	dir, name string
+}
+
+// PackageCommentFiles returns the file among files that should get a package
+// comment, see Options.PackageComment, for each package without one. A
+// package has one if any of its files does, including files that aren't
+// among files, such as doc.go. The file to document a package is its doc.go,
+// else the file named after the package, else the first of its files in
+// files. Files with anything directly above their package clause, such as a
+// build constraint, leave no room for a package comment. _test.go files
+// don't count, since go doc ignores them, and neither do files that don't
+// parse.
+func PackageCommentFiles(files []string) map[string]bool {
+	candidates := make(map[packageID][]string)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		node, err := parsePackageClause(file)
+		if err != nil || node.Doc != nil {
+			continue
+		}
+		id := packageID{filepath.Dir(file), node.Name.Name}
+		candidates[id] = append(candidates[id], file)
+	}
+
+	documented := make(map[packageID]bool)
+	scanned := make(map[string]bool)
+	for id := range candidates {
+		if scanned[id.dir] {
+			continue
+		}
+		scanned[id.dir] = true
+		entries, err := os.ReadDir(id.dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			base := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(base, ".go") || strings.HasSuffix(base, "_test.go") {
+				continue
+			}
+			node, err := parsePackageClause(filepath.Join(id.dir, base))
+			if err == nil && hasPackageDoc(node.Doc) {
+				documented[packageID{id.dir, node.Name.Name}] = true
+			}
+		}
+	}
+
+	targets := make(map[string]bool)
+	for id, pkgFiles := range candidates {
+		if !documented[id] {
+			targets[choosePackageCommentFile(id.name, pkgFiles)] = true
+		}
+	}
+	return targets
+}
+
+// parsePackageClause parses the package clause of the Go file at path along
+// with the comments above it.
+func parsePackageClause(path string) (*ast.File, error) {
+	return parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+}
+
+// hasPackageDoc reports whether doc holds documentation rather than only
+// directives.
+func hasPackageDoc(doc *ast.CommentGroup) bool {
+	return doc != nil && strings.TrimSpace(doc.Text()) != ""
+}
+
+// choosePackageCommentFile returns the file among files of the package
+// name that gets the package comment, see PackageCommentFiles.
+func choosePackageCommentFile(name string, files []string) string {
+	files = append([]string(nil), files...)
+	sort.Strings(files)
+	for _, preferred := range []string{"doc.go", name + ".go"} {
+		for _, file := range files {
+			if filepath.Base(file) == preferred {
+				return file
+			}
+		}
+	}
+	return files[0]
+}
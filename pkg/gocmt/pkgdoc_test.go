@@ -0,0 +1,252 @@
+package gocmt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAddPackageComment(t *testing.T) {
+	comments := []Comment{{Position: "package p", Comment: "Package p provides helpers."}}
+	tests := []struct {
+		name string
+		src  string
+		opts Options
+		want string
+	}{
+		{
+			name: "no package comment",
+			src:  "package p\n\nfunc F() {}\n",
+			opts: Options{PackageComment: true},
+			want: "// Package p provides helpers.\npackage p\n\nfunc F() {}\n",
+		},
+		{
+			name: "existing package comment",
+			src:  "// Package p does things.\npackage p\n",
+			opts: Options{PackageComment: true},
+			want: "// Package p does things.\npackage p\n",
+		},
+		{
+			name: "not asked for",
+			src:  "package p\n",
+			want: "package p\n",
+		},
+		{
+			name: "after header",
+			src:  "// SPDX-License-Identifier: MIT\n\n//go:build linux\n\npackage p\n",
+			opts: Options{PackageComment: true},
+			want: "// SPDX-License-Identifier: MIT\n\n//go:build linux\n\n// Package p provides helpers.\npackage p\n",
+		},
+		{
+			name: "unexported scope",
+			src:  "package p\n",
+			opts: Options{PackageComment: true, Scope: ScopeUnexported},
+			want: "package p\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(tt.src, comments, tt.opts)
+			if err != nil {
+				t.Fatalf("AddComments() error = %v", err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("AddComments() =\n%s\nwant\n%s", result.Code, tt.want)
+			}
+			if len(result.Unmatched) != 0 {
+				t.Errorf("AddComments() unmatched %v", result.Unmatched)
+			}
+		})
+	}
+}
+
+func TestPackageComment(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Package p provides helpers.", "Package p provides helpers."},
+		{"p provides helpers.", "Package p provides helpers."},
+		{"This package provides helpers.", "Package p provides helpers."},
+		{"Provides helpers.", "Package p provides helpers."},
+	}
+	for _, tt := range tests {
+		if got := packageComment(tt.text, "p"); got != tt.want {
+			t.Errorf("packageComment(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratePackageComment(t *testing.T) {
+	src := "package p\n\nfunc F() {}\n"
+	response := commentsResponse("package p", "This package provides F.", "func F() {", "F does nothing.")
+	for _, noReformat := range []bool{false, true} {
+		client := &fakeClient{content: response}
+		g, err := NewCommentGenerator(Options{Client: client, GodocStyle: true, NoReformat: noReformat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := g.GenerateCommentsWithPackageComment(context.Background(), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "// Package p provides F.\npackage p\n\n// F does nothing.\nfunc F() {}\n"
+		if got != want {
+			t.Errorf("GenerateCommentsWithPackageComment(NoReformat: %v) =\n%s\nwant\n%s", noReformat, got, want)
+		}
+		req := client.requests[0]
+		if prompt := req.Messages[0].Content; !strings.Contains(prompt, "package comment") {
+			t.Errorf("prompt doesn't ask for a package comment:\n%s", prompt)
+		}
+		if code := req.Messages[len(req.Messages)-1].Content; !strings.Contains(code, "package p\n") {
+			t.Errorf("package clause not sent:\n%s", code)
+		}
+
+		// GenerateComments leaves the package clause alone.
+		client = &fakeClient{content: response}
+		g, _ = NewCommentGenerator(Options{Client: client, NoReformat: noReformat})
+		got, err = g.GenerateComments(context.Background(), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(got, "Package p") {
+			t.Errorf("GenerateComments() added a package comment without being asked:\n%s", got)
+		}
+	}
+}
+
+func TestProcessGoCodePackageClause(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		opts Options
+		want []string
+	}{
+		{"wanted", "package p\n\nfunc F() {}\n", Options{PackageComment: true}, []string{"package p", "func F() {}"}},
+		{"documented", "// Package p is p.\npackage p\n\nfunc F() {}\n", Options{PackageComment: true}, []string{"func F() {}"}},
+		{"not asked for", "package p\n\nfunc F() {}\n", Options{}, []string{"func F() {}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProcessGoCode(tt.src, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProcessGoCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeFiles creates the files, given by their slash-separated path
+// relative to dir, with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPackageCommentFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		processed []string
+		want      []string
+	}{
+		{
+			name: "existing doc.go",
+			files: map[string]string{
+				"doc.go": "// Package p does things.\npackage p\n",
+				"a.go":   "package p\n",
+			},
+			processed: []string{"a.go", "doc.go"},
+		},
+		{
+			name: "package comment in a file not processed",
+			files: map[string]string{
+				"a.go": "package p\n",
+				"b.go": "// Package p does things.\npackage p\n",
+			},
+			processed: []string{"a.go"},
+		},
+		{
+			name: "no package comment",
+			files: map[string]string{
+				"a.go": "package p\n",
+				"b.go": "package p\n",
+			},
+			processed: []string{"b.go", "a.go"},
+			want:      []string{"a.go"},
+		},
+		{
+			name: "file named after the package",
+			files: map[string]string{
+				"a.go": "package p\n",
+				"p.go": "package p\n",
+			},
+			processed: []string{"a.go", "p.go"},
+			want:      []string{"p.go"},
+		},
+		{
+			name: "empty doc.go",
+			files: map[string]string{
+				"doc.go": "package p\n",
+				"p.go":   "package p\n",
+			},
+			processed: []string{"doc.go", "p.go"},
+			want:      []string{"doc.go"},
+		},
+		{
+			name: "build constraint and tests",
+			files: map[string]string{
+				"a.go":      "//go:build linux\npackage p\n",
+				"b.go":      "//go:build linux\n\npackage p\n",
+				"a_test.go": "// Package p is documented in a test.\npackage p\n",
+			},
+			processed: []string{"a.go", "b.go", "a_test.go"},
+			want:      []string{"b.go"},
+		},
+		{
+			name: "packages in several directories",
+			files: map[string]string{
+				"x/a.go":   "package x\n",
+				"y/a.go":   "package y\n",
+				"y/doc.go": "// Package y does things.\npackage y\n",
+				"z/gen.go": "//go:build ignore\n\npackage main\n",
+				"z/z.go":   "package z\n",
+			},
+			processed: []string{"x/a.go", "y/a.go", "z/gen.go", "z/z.go"},
+			want:      []string{"x/a.go", "z/gen.go", "z/z.go"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			var processed []string
+			for _, name := range tt.processed {
+				processed = append(processed, filepath.Join(dir, filepath.FromSlash(name)))
+			}
+			var got []string
+			for file := range PackageCommentFiles(processed) {
+				rel, _ := filepath.Rel(dir, file)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PackageCommentFiles() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
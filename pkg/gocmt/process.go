@@ -0,0 +1,186 @@
+package gocmt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// ProcessGoCode strips function bodies, unless opts.KeepBodies is set or
+// the function is explained for opts.Explain, the package clause and
+// imports from goCode, and returns the remaining top-level declarations one
+// per element. The package clause is kept as the first element if the file
+// is to get a package comment, see Options.PackageComment.
+func ProcessGoCode(goCode string, opts Options) ([]string, error) {
+	opts, err := opts.withLineDecls(goCode)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", goCode, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Go code: %w", err)
+	}
+
+	if !opts.KeepBodies {
+		ast.Inspect(node, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncDecl:
+				if x.Body != nil && !opts.explained(x) {
+					replaceFuncBody(x)
+				}
+			}
+			return true
+		})
+	}
+
+	// The package clause is the position of a package comment, and goes
+	// with every chunk anyway with KeepImports.
+	var clause string
+	wanted, err := packageCommentWanted(goCode, opts)
+	if err != nil {
+		return nil, err
+	}
+	if wanted && !opts.KeepImports {
+		clause = "package " + node.Name.Name
+	}
+	removePackageAndImports(node)
+	removeOutOfScope(node, opts)
+
+	// Print the remaining declarations one by one, which leaves out the
+	// package clause.
+	decls := make([]string, 0, len(node.Decls)+1)
+	if clause != "" {
+		decls = append(decls, clause)
+	}
+	for _, decl := range node.Decls {
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, decl); err != nil {
+			return nil, fmt.Errorf("formatting Go code: %w", err)
+		}
+		decls = append(decls, strings.TrimSpace(buf.String()))
+	}
+	return decls, nil
+}
+
+// fileContext returns the package clause and the imports of goCode, which
+// are sent along with every chunk of declarations for Options.KeepImports.
+func fileContext(goCode string) (string, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "", goCode, parser.ImportsOnly)
+	if err != nil {
+		return "", fmt.Errorf("parsing Go code: %w", err)
+	}
+	var sb strings.Builder
+	sb.WriteString("package " + node.Name.Name)
+	for _, decl := range node.Decls {
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, decl); err != nil {
+			return "", fmt.Errorf("formatting Go code: %w", err)
+		}
+		sb.WriteString("\n\n" + buf.String())
+	}
+	return sb.String(), nil
+}
+
+// removePackageAndImports drops all import declarations from node, whether
+// they are grouped, single-line or absent altogether.
+func removePackageAndImports(node *ast.File) {
+	decls := node.Decls[:0]
+	for _, decl := range node.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	node.Decls = decls
+	node.Imports = nil
+	node.Name = nil
+}
+
+// removeOutOfScope drops the declarations that won't get comments according
+// to opts, so that no tokens are spent on them.
+func removeOutOfScope(node *ast.File, opts Options) {
+	decls := node.Decls[:0]
+	for _, decl := range node.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if initFunc(d) || !opts.includes(d.Name.Name) || !opts.inLines(funcKey(d)) {
+				continue
+			}
+		case *ast.GenDecl:
+			specs := d.Specs[:0]
+			for _, spec := range d.Specs {
+				if specIncluded(spec, opts) {
+					specs = append(specs, spec)
+				}
+			}
+			d.Specs = specs
+			if len(d.Specs) == 0 {
+				continue
+			}
+		}
+		decls = append(decls, decl)
+	}
+	node.Decls = decls
+}
+
+// specIncluded reports whether any name declared by spec is in scope.
+func specIncluded(spec ast.Spec, opts Options) bool {
+	switch s := spec.(type) {
+	case *ast.TypeSpec:
+		return opts.includes(s.Name.Name) && opts.inLines(s.Name.Name)
+	case *ast.ValueSpec:
+		if !opts.inLines(s.Names[0].Name) {
+			return false
+		}
+		for _, ident := range s.Names {
+			if opts.includes(ident.Name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// SyntaxError is returned for Go code that doesn't parse.
+type SyntaxError struct {
+	// Line is the line of the first error.
+	Line int
+	// Msg describes the first error.
+	Msg string
+}
+
+// Error implements the error interface.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d: %s", e.Line, e.Msg)
+}
+
+// FormatGoCode formats goCode like gofmt. Code that doesn't parse results
+// in a *SyntaxError.
+func FormatGoCode(goCode string) (string, error) {
+	// Format the provided Go code
+	formatted, err := format.Source([]byte(goCode))
+	if err != nil {
+		var list scanner.ErrorList
+		if errors.As(err, &list) && len(list) > 0 {
+			return "", &SyntaxError{Line: list[0].Pos.Line, Msg: list[0].Msg}
+		}
+		return "", fmt.Errorf("failed to format Go code: %v", err)
+	}
+	return string(formatted), nil
+}
+
+// replaceFuncBody replaces the body of decl with an empty block, which
+// keeps the signature, including the opening brace the comment positions
+// refer to, in code that still parses.
+func replaceFuncBody(decl *ast.FuncDecl) {
+	decl.Body = &ast.BlockStmt{}
+}
@@ -0,0 +1,213 @@
+package gocmt
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessGoCodeImports(t *testing.T) {
+	want := []string{"func F() {}"}
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"no imports", "package p\n\nfunc F() {}\n"},
+		{"single import", "package p\n\nimport \"fmt\"\n\nfunc F() {\n\tfmt.Println()\n}\n"},
+		{"grouped imports", "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc F() {\n\tfmt.Println(os.Args)\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProcessGoCode(tt.src, Options{})
+			if err != nil {
+				t.Fatalf("ProcessGoCode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ProcessGoCode() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProcessGoCode(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		opts Options
+		want []string
+	}{
+		{
+			name: "bodies stripped",
+			src:  "package p\n\nimport \"fmt\"\n\nfunc Hello() {\n\tfmt.Println(\"hi\")\n}\n\ntype T struct{ X int }\n",
+			want: []string{"func Hello() {}", "type T struct{ X int }"},
+		},
+		{
+			name: "bodies kept",
+			src:  "package p\n\nfunc Hello() int {\n\treturn 1\n}\n",
+			opts: Options{KeepBodies: true},
+			want: []string{"func Hello() int {\n\treturn 1\n}"},
+		},
+		{
+			name: "type parameters",
+			src:  "package p\n\nfunc Map[T, U any](s []T, f func(T) U) []U {\n\treturn nil\n}\n\ntype List[T any] struct{ items []T }\n",
+			want: []string{"func Map[T, U any](s []T, f func(T) U) []U {}", "type List[T any] struct{ items []T }"},
+		},
+		{
+			name: "exported scope",
+			src:  "package p\n\nfunc Hello() {}\n\nfunc hello() {}\n\nvar x, Y int\n\nvar z int\n",
+			opts: Options{Scope: ScopeExported},
+			want: []string{"func Hello() {}", "var x, Y int"},
+		},
+		{
+			name: "init functions",
+			src:  "package p\n\nfunc init() {}\n\nfunc F() {}\n\nfunc init() {}\n",
+			want: []string{"func F() {}"},
+		},
+		{
+			name: "no declarations",
+			src:  "package p\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n",
+			want: []string{"var _ = fmt.Sprint"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProcessGoCode(tt.src, tt.opts)
+			if err != nil {
+				t.Fatalf("ProcessGoCode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProcessGoCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovePackageAndImports(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"no imports", "package p\n\nfunc F() {}\n"},
+		{"single import", "package p\n\nimport \"fmt\"\n\nfunc F() { fmt.Println() }\n"},
+		{"grouped imports", "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc F() { fmt.Println(os.Args) }\n"},
+		{"several import declarations", "package p\n\nimport \"fmt\"\nimport \"os\"\n\nfunc F() { fmt.Println(os.Args) }\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parser.ParseFile(token.NewFileSet(), "", tt.src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			removePackageAndImports(node)
+			if node.Name != nil || node.Imports != nil {
+				t.Errorf("package name %v or imports %v left", node.Name, node.Imports)
+			}
+			if len(node.Decls) != 1 {
+				t.Fatalf("%d declarations left, want 1", len(node.Decls))
+			}
+			if fn, ok := node.Decls[0].(*ast.FuncDecl); !ok || fn.Name.Name != "F" {
+				t.Errorf("declaration left is %T, want func F", node.Decls[0])
+			}
+		})
+	}
+}
+
+func TestFormatGoCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		want     string
+		wantLine int
+	}{
+		{
+			name: "formatted",
+			src:  "package p\nfunc F( ) {\nreturn\n}\n",
+			want: "package p\n\nfunc F() {\n\treturn\n}\n",
+		},
+		{
+			name: "already formatted",
+			src:  "package p\n\nvar x = 1\n",
+			want: "package p\n\nvar x = 1\n",
+		},
+		{
+			name:     "syntax error",
+			src:      "package p\n\nfunc F( {\n",
+			wantLine: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatGoCode(tt.src)
+			if tt.wantLine > 0 {
+				var syntaxErr *SyntaxError
+				if !errors.As(err, &syntaxErr) || syntaxErr.Line != tt.wantLine {
+					t.Fatalf("FormatGoCode() error = %v, want a syntax error at line %d", err, tt.wantLine)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FormatGoCode() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("FormatGoCode() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessGoCodeParses(t *testing.T) {
+	src := `package p
+
+import "errors"
+
+type Server struct{ addr string }
+
+func (s *Server) Start(addr string) error {
+	if addr == "" {
+		return errors.New("no address")
+	}
+	s.addr = addr
+	return nil
+}
+
+func Map[T, U any](s []T, f func(T) U) []U {
+	var out []U
+	for _, v := range s {
+		out = append(out, f(v))
+	}
+	return out
+}
+
+func Values() (a, b int) { return 1, 2 }
+
+func run(ctx interface{ Done() <-chan struct{} }) {
+	<-ctx.Done()
+}
+`
+	decls, err := ProcessGoCode(src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := "package p\n\n" + strings.Join(decls, "\n\n") + "\n"
+	node, err := parser.ParseFile(token.NewFileSet(), "", stripped, 0)
+	if err != nil {
+		t.Fatalf("stripped code doesn't parse: %v\n%s", err, stripped)
+	}
+	if len(node.Decls) != 5 {
+		t.Errorf("stripped code has %d declarations, want 5", len(node.Decls))
+	}
+
+	// The first line of every declaration, which the model copies as the
+	// position, is the line in the original.
+	for _, decl := range decls {
+		first, _, _ := strings.Cut(decl, "\n")
+		first = strings.TrimSuffix(first, "}")
+		if !strings.Contains(src, "\n"+first) {
+			t.Errorf("first line %q of\n%s\nisn't in the original", first, decl)
+		}
+	}
+}
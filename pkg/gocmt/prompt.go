@@ -0,0 +1,241 @@
+package gocmt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// commentLanguages maps the supported language codes to the language name used
+// in the prompt.
+var commentLanguages = map[string]string{
+	"en": "English",
+	"zh": "Simplified Chinese",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"fr": "French",
+	"de": "German",
+	"es": "Spanish",
+}
+
+// systemPromptTemplate holds the instructions sent to the model as the system
+// message. The verbs are replaced by the language sentence and the optional
+// requirements.
+const systemPromptTemplate = `### Role ###
+You are a Go language expert with a solid foundation in Go and high standards for code comments. %s
+### Requirements ###
+- Add meaningful and technical comments above each structure, method, function, and other key code.
+- Start each comment with the name of the declaration it describes. For methods, start with the method name rather than the receiver, e.g. "Start starts the server." for "func (s *Server) Start() {", and use the receiver type to understand what the method operates on.
+- For generic declarations, copy the type parameter list into the position as written, e.g. "func Map[T, U any](s []T, f func(T) U) []U {" or "type List[T any] struct {", and describe the type parameters and their constraints where it helps.
+- Also comment each method of an interface, describing its contract, using the interface name and the method name as the position, e.g. "Store.Get" for the Get method of "type Store interface {".
+- Also comment package-level variables and constants, using "var" or "const" and the name as the position, e.g. "var ErrNotFound" or "const MaxRetries", also for those declared in a group; for names declared together, such as "var a, b int", use the first name.
+- Mark the code position and supplementary annotations in a structured manner, and output all the comments that need to be supplemented in JSON format
+- The return result is plain text, and three backticks are not needed.
+%s### Output Format Example ###
+{
+    "comments": [
+        {
+            "position": "type MockManagerInterface interface {",
+            "comment": "MockManagerInterface defines the interface for mock manager."
+        },
+        {
+            "position": "type mockManager struct {",
+            "comment": "mockManager is the implementation that mock manager."
+        }
+    ]
+}
+`
+
+// userPromptPrefix introduces the code to comment in the user message.
+const userPromptPrefix = "### Target Code ###\n"
+
+// chatPrompt holds the messages sent to the model.
+type chatPrompt struct {
+	// system is the system message with the instructions, empty to send
+	// the user message alone.
+	system string
+	// user is the user message with the code to comment.
+	user string
+}
+
+// String returns both messages as one text, e.g. for cache keys.
+func (p chatPrompt) String() string {
+	if p.system == "" {
+		return p.user
+	}
+	return p.system + "\x00" + p.user
+}
+
+// messages returns the chat messages of p.
+func (p chatPrompt) messages() []openai.ChatCompletionMessage {
+	var msgs []openai.ChatCompletionMessage
+	if p.system != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: p.system})
+	}
+	return append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: p.user})
+}
+
+// ValidateLanguage returns an error if lang is not a supported language code.
+func ValidateLanguage(lang string) error {
+	if _, ok := commentLanguages[lang]; ok {
+		return nil
+	}
+	codes := make([]string, 0, len(commentLanguages))
+	for code := range commentLanguages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return fmt.Errorf("unsupported language %q, must be one of: %s", lang, strings.Join(codes, ", "))
+}
+
+// languageInstruction returns the prompt sentence that tells the model which
+// language to write comments in.
+func languageInstruction(lang string) string {
+	name, ok := commentLanguages[lang]
+	if !ok || lang == "en" {
+		return "Additionally, your English is excellent, enabling you to write professional English comments."
+	}
+	return fmt.Sprintf("Additionally, your %s is excellent, enabling you to write professional %s comments. "+
+		"Write the comment text in %s, but keep identifier names, code and the JSON keys unchanged.", name, name, name)
+}
+
+// fieldsRequirement asks the model to also comment struct fields, see
+// Options.Fields.
+const fieldsRequirement = `- Also comment each exported struct field, using the struct name and the field name as the position, e.g. "Server.Addr" for the Addr field of "type Server struct {". For embedded fields use the type name without package or pointer, e.g. "Server.Mutex" for "sync.Mutex", and for fields declared together such as "X, Y int" use the first name.
+`
+
+// importsRequirement tells the model that the package clause and imports
+// are context only, see Options.KeepImports.
+const importsRequirement = `- The package clause and the imports at the top of the code are context, e.g. to name the dependencies used in the comments; don't comment them.
+`
+
+// bodiesRequirement tells the model how to use the function bodies, see
+// Options.KeepBodies.
+const bodiesRequirement = `- Function bodies are included to show what the code does. Describe the behavior in the comments of the declarations, and don't comment statements inside the bodies.
+`
+
+// maxCommentsRequirement limits the comments the model returns, see
+// Options.MaxComments.
+const maxCommentsRequirement = `- Return at most %d comments, prioritizing the most important exported declarations over trivial helpers.
+`
+
+// explainRequirement asks for an explanatory paragraph on complex
+// functions, see Options.Explain.
+const explainRequirement = `- The bodies of the non-trivial functions (%s) are included. For these, follow the one-sentence summary with an empty line ("\n\n" in the comment) and a short paragraph explaining how the function works and why, without restating the code line by line. Keep all other comments to the summary.
+`
+
+// buildPrompt renders the prompt for the given processed code according to
+// opts. The built-in instructions go into the system message unless
+// opts.NoSystemPrompt is set, a custom system prompt replaces them, and a
+// custom prompt template renders the user message, without the built-in
+// instructions unless a system prompt is given as well.
+func buildPrompt(code string, opts Options) (chatPrompt, error) {
+	var p chatPrompt
+	var err error
+	if opts.SystemPromptTemplate != nil {
+		p.system, err = renderPrompt(opts.SystemPromptTemplate, "", opts.Language)
+		if err != nil {
+			return chatPrompt{}, err
+		}
+	} else if opts.PromptTemplate == nil {
+		p.system = builtinSystemPrompt(opts)
+	}
+	if opts.PromptTemplate != nil {
+		p.user, err = renderPrompt(opts.PromptTemplate, code, opts.Language)
+		if err != nil {
+			return chatPrompt{}, err
+		}
+	} else {
+		p.user = userPromptPrefix + code
+	}
+	if opts.NoSystemPrompt && p.system != "" {
+		// Everything in one user message, for models that ignore or reject
+		// system messages.
+		p = chatPrompt{user: strings.TrimRight(p.system, "\n") + "\n" + p.user}
+	}
+	return p, nil
+}
+
+// builtinSystemPrompt renders the built-in instructions according to opts.
+func builtinSystemPrompt(opts Options) string {
+	var requirements string
+	if opts.Fields {
+		requirements += fieldsRequirement
+	}
+	if opts.KeepImports {
+		requirements += importsRequirement
+	}
+	if opts.KeepBodies {
+		requirements += bodiesRequirement
+	}
+	if opts.MaxComments > 0 {
+		requirements += fmt.Sprintf(maxCommentsRequirement, opts.MaxComments)
+	}
+	if opts.PackageComment {
+		requirements += packageCommentRequirement
+	}
+	if len(opts.explainFuncs) > 0 {
+		requirements += fmt.Sprintf(explainRequirement, strings.Join(opts.explainFuncs, ", "))
+	}
+	return fmt.Sprintf(systemPromptTemplate, languageInstruction(opts.Language), requirements)
+}
+
+// codePlaceholderRe matches the {{.Code}} action a custom prompt template
+// must contain.
+var codePlaceholderRe = regexp.MustCompile(`\{\{-?\s*\.Code\s*-?\}\}`)
+
+// promptData is the data a custom prompt template is executed with.
+type promptData struct {
+	// Code is the processed Go code to comment.
+	Code string
+	// Language is the name of the language comments are written in.
+	Language string
+}
+
+// LoadSystemPromptTemplate reads and parses the custom system prompt
+// template at path. It may reference the comment language with
+// {{.Language}}; the code is sent in the user message.
+func LoadSystemPromptTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system prompt file: %v", err)
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse system prompt file: %v", err)
+	}
+	return tmpl, nil
+}
+
+// LoadPromptTemplate reads and parses the custom prompt template at path,
+// which must reference the code with {{.Code}}.
+func LoadPromptTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt file: %v", err)
+	}
+	if !codePlaceholderRe.Match(data) {
+		return nil, fmt.Errorf("prompt file %s must contain the {{.Code}} placeholder", path)
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt file: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderPrompt executes a custom prompt template for the given processed
+// code and comment language.
+func renderPrompt(tmpl *template.Template, code, lang string) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, promptData{Code: code, Language: commentLanguages[lang]}); err != nil {
+		return "", fmt.Errorf("failed to render prompt: %v", err)
+	}
+	return buf.String(), nil
+}
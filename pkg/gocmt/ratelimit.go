@@ -0,0 +1,55 @@
+package gocmt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out requests evenly so that no more than a given
+// number start per minute. It is a token bucket holding a single token, so
+// concurrent callers don't cause bursts.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is the earliest time the next request may start.
+	next time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests per minute,
+// or nil for no limit if perMinute is zero or less.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// wait blocks until a request may start or ctx is done. A nil limiter never
+// blocks.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,61 @@
+package gocmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// parseComments extracts the comments from a model response. The response
+// may wrap the JSON object in markdown fences or surround it with prose, so
+// the first balanced JSON object that decodes successfully is used.
+func parseComments(content string) ([]Comment, error) {
+	for start := strings.IndexByte(content, '{'); start >= 0; {
+		if end := matchingBrace(content, start); end > 0 {
+			var comments CommentJSON
+			if err := json.Unmarshal([]byte(content[start:end+1]), &comments); err == nil {
+				return comments.Comments, nil
+			}
+		}
+		next := strings.IndexByte(content[start+1:], '{')
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return nil, fmt.Errorf("no valid comments JSON found in model response")
+}
+
+// matchingBrace returns the index of the brace closing the one at start,
+// skipping braces inside JSON strings, or -1 if it is unbalanced.
+func matchingBrace(s string, start int) int {
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,38 @@
+package gocmt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseComments(t *testing.T) {
+	want := []Comment{{Position: "func F() {", Comment: "F does {nothing}."}}
+	object := `{"comments": [{"position": "func F() {", "comment": "F does {nothing}."}]}`
+	tests := []struct {
+		name    string
+		content string
+		want    []Comment
+		wantErr bool
+	}{
+		{"bare", object, want, false},
+		{"json fence", "```json\n" + object + "\n```", want, false},
+		{"plain fence", "```\n" + object + "\n```", want, false},
+		{"prose around", "Here are the comments:\n\n" + object + "\n\nLet me know if you need more.", want, false},
+		{"braces in prose", "Comments for {your code} follow: " + object, want, false},
+		{"escaped quotes", `{"comments": [{"position": "func F() {", "comment": "F prints \"}\"."}]}`, []Comment{{Position: "func F() {", Comment: `F prints "}".`}}, false},
+		{"no comments", `{"comments": []}`, []Comment{}, false},
+		{"truncated", `{"comments": [{"position": "func F() {"`, nil, true},
+		{"no JSON", "I can't comment this code.", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseComments(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseComments() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseComments() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package gocmt
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// overloadRetries is how many times a request to an overloaded model is
+// retried before falling back to the next model.
+const overloadRetries = 2
+
+// maxRetryAfter bounds the wait a Retry-After header can ask for.
+const maxRetryAfter = time.Minute
+
+// overloadBackoff is the wait before the first retry of an overloaded model
+// when the response has no Retry-After header. It doubles with each retry.
+var overloadBackoff = time.Second
+
+// retryAfterKey is the context key of the *retryAfter a request records its
+// Retry-After header in.
+type retryAfterKey struct{}
+
+// retryAfter holds the wait asked for by the Retry-After header of a
+// response. go-openai drops the headers of failed responses, so
+// retryAfterTransport records it through the request context.
+type retryAfter struct {
+	mu    sync.Mutex
+	delay time.Duration
+	ok    bool
+}
+
+// withRetryAfter returns a copy of ctx in which the Retry-After header of the
+// response to a request is recorded, and the place it is recorded in.
+func withRetryAfter(ctx context.Context) (context.Context, *retryAfter) {
+	ra := &retryAfter{}
+	return context.WithValue(ctx, retryAfterKey{}, ra), ra
+}
+
+// setRetryAfter records delay in the retryAfter of ctx, if any.
+func setRetryAfter(ctx context.Context, delay time.Duration) {
+	if ra, ok := ctx.Value(retryAfterKey{}).(*retryAfter); ok {
+		ra.mu.Lock()
+		ra.delay, ra.ok = delay, true
+		ra.mu.Unlock()
+	}
+}
+
+// get returns the recorded wait, capped at maxRetryAfter, and whether there
+// is one.
+func (ra *retryAfter) get() (time.Duration, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.delay > maxRetryAfter {
+		return maxRetryAfter, ra.ok
+	}
+	return ra.delay, ra.ok
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number
+// of seconds or an HTTP date, relative to now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// retryAfterTransport records the Retry-After header of every response sent
+// through base in the request context, see withRetryAfter.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		setRetryAfter(req.Context(), delay)
+	}
+	return resp, nil
+}
+
+// withRetryAfterTransport returns a copy of httpClient, or of the default
+// client if nil, whose transport records Retry-After headers.
+func withRetryAfterTransport(httpClient *http.Client) *http.Client {
+	client := &http.Client{}
+	if httpClient != nil {
+		*client = *httpClient
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &retryAfterTransport{base: base}
+	return client
+}
+
+// sleep waits for delay or until ctx is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
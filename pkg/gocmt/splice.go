@@ -0,0 +1,91 @@
+package gocmt
+
+import (
+	"sort"
+	"strings"
+)
+
+// spliceComments inserts the applied comments into src as text, above the
+// lines of their declarations and with the same indentation, leaving the rest
+// of src byte for byte as it was. With opts.Overwrite the comment lines
+// directly above a declaration, its old doc comment, are replaced. Directives
+// such as //go:generate stay directly above the declaration, below the new
+// comment.
+func spliceComments(src string, applied []AppliedComment, opts Options) string {
+	newline := "\n"
+	if strings.Contains(src, "\r\n") {
+		newline = "\r\n"
+	}
+	lines := strings.SplitAfter(src, "\n")
+
+	// Splice from the bottom up so that the line numbers of the comments
+	// still to insert stay valid.
+	applied = append([]AppliedComment(nil), applied...)
+	sort.SliceStable(applied, func(i, j int) bool {
+		return applied[i].Line > applied[j].Line
+	})
+	for _, c := range applied {
+		i := c.Line - 1
+		if i < 0 || i >= len(lines) {
+			continue
+		}
+		line := lines[i]
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+
+		// A declaration gets a comment only if the lines above it hold no
+		// documentation or opts.Overwrite is set, so that only directives
+		// remain of them.
+		start := docStart(lines, i)
+		var directives []string
+		for _, line := range lines[start:i] {
+			if isDirective(strings.TrimSpace(line)) {
+				directives = append(directives, line)
+			}
+		}
+		if !opts.Overwrite && len(directives) == 0 {
+			start = i
+		}
+		var doc []string
+		for _, text := range commentLines(c.Text, opts) {
+			if text == "" {
+				// A blank line within a block comment.
+				doc = append(doc, newline)
+				continue
+			}
+			doc = append(doc, indent+text+newline)
+		}
+		if len(directives) > 0 {
+			if opts.Style != StyleBlock || len(doc) == 1 {
+				doc = append(doc, indent+"//"+newline)
+			}
+			doc = append(doc, directives...)
+		}
+		lines = append(lines[:start], append(doc, lines[i:]...)...)
+	}
+	return strings.Join(lines, "")
+}
+
+// docStart returns the index of the first line of the comments directly
+// above lines[i], "//" lines or a /* */ block, or i if there are none.
+func docStart(lines []string, i int) int {
+	start := i
+	for start > 0 {
+		prev := strings.TrimSpace(lines[start-1])
+		switch {
+		case strings.HasPrefix(prev, "//"):
+			start--
+		case strings.HasSuffix(prev, "*/"):
+			j := start - 1
+			for j >= 0 && !strings.HasPrefix(strings.TrimSpace(lines[j]), "/*") {
+				j--
+			}
+			if j < 0 {
+				return start
+			}
+			start = j
+		default:
+			return start
+		}
+	}
+	return start
+}
@@ -0,0 +1,83 @@
+package gocmt
+
+import (
+	"go/format"
+	"testing"
+)
+
+func TestSpliceComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		comments []Comment
+		opts     Options
+		want     string
+		// spaces marks sources indented with spaces, which gofmt would
+		// change regardless of the comments.
+		spaces bool
+	}{
+		{
+			name:     "top-level function",
+			src:      "package p\n\nfunc F() {}\n",
+			comments: []Comment{{Position: "func F() {", Comment: "F does nothing."}},
+			want:     "package p\n\n// F does nothing.\nfunc F() {}\n",
+		},
+		{
+			name:     "interface method",
+			src:      "package p\n\ntype I interface {\n\tM() error\n}\n",
+			comments: []Comment{{Position: "I.M", Comment: "M does something."}},
+			want:     "package p\n\ntype I interface {\n\t// M does something.\n\tM() error\n}\n",
+		},
+		{
+			name:     "struct field",
+			src:      "package p\n\ntype T struct {\n\tName string\n}\n",
+			comments: []Comment{{Position: "T.Name", Comment: "Name is the name."}},
+			opts:     Options{Fields: true},
+			want:     "package p\n\ntype T struct {\n\t// Name is the name.\n\tName string\n}\n",
+		},
+		{
+			name: "grouped specs",
+			src:  "package p\n\nconst (\n\tA = 1\n\tB = 2\n)\n\ntype (\n\tX int\n\tY int\n)\n",
+			comments: []Comment{
+				{Position: "const B", Comment: "B is two."},
+				{Position: "type Y int", Comment: "Y is an int."},
+			},
+			want: "package p\n\nconst (\n\tA = 1\n\t// B is two.\n\tB = 2\n)\n\ntype (\n\tX int\n\t// Y is an int.\n\tY int\n)\n",
+		},
+		{
+			name:     "nested directive",
+			src:      "package p\n\ntype (\n\t//go:generate stringer -type=X\n\tX int\n)\n",
+			comments: []Comment{{Position: "type X int", Comment: "X is an int."}},
+			want:     "package p\n\ntype (\n\t// X is an int.\n\t//\n\t//go:generate stringer -type=X\n\tX int\n)\n",
+		},
+		{
+			name:     "spaces",
+			src:      "package p\n\ntype I interface {\n    M() error\n}\n",
+			comments: []Comment{{Position: "I.M", Comment: "M does something."}},
+			want:     "package p\n\ntype I interface {\n    // M does something.\n    M() error\n}\n",
+			spaces:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := AddComments(tt.src, tt.comments, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := spliceComments(tt.src, result.Applied, tt.opts)
+			if got != tt.want {
+				t.Errorf("spliceComments() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if tt.spaces {
+				return
+			}
+			formatted, err := format.Source([]byte(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(formatted) != got {
+				t.Errorf("spliceComments() output isn't gofmt-clean, gofmt gives\n%s", formatted)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package gocmt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// commentsToolName is the name of the tool the model calls with the comments
+// in structured mode.
+const commentsToolName = "comments"
+
+// commentsTool describes a tool whose arguments have the shape of
+// CommentJSON, so that the API returns the comments as structured JSON.
+var commentsTool = openai.Tool{
+	Type: openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{
+		Name:        commentsToolName,
+		Description: "Add the given doc comments to the Go code.",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"comments": {
+					Type: jsonschema.Array,
+					Items: &jsonschema.Definition{
+						Type: jsonschema.Object,
+						Properties: map[string]jsonschema.Definition{
+							"position": {
+								Type:        jsonschema.String,
+								Description: "The first line of the declaration the comment belongs to, e.g. \"func (s *Server) Start() {\".",
+							},
+							"comment": {
+								Type:        jsonschema.String,
+								Description: "The doc comment text, without the // markers.",
+							},
+						},
+						Required: []string{"position", "comment"},
+					},
+				},
+			},
+			Required: []string{"comments"},
+		},
+	},
+}
+
+// useCommentsTool makes req require a call of the comments tool.
+func useCommentsTool(req *openai.ChatCompletionRequest) {
+	req.Tools = []openai.Tool{commentsTool}
+	req.ToolChoice = openai.ToolChoice{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.ToolFunction{Name: commentsToolName},
+	}
+}
+
+// toolArguments returns the arguments of the comments tool call in msg.
+func toolArguments(msg openai.ChatCompletionMessage) (string, error) {
+	for _, call := range msg.ToolCalls {
+		if call.Function.Name == commentsToolName {
+			return call.Function.Arguments, nil
+		}
+	}
+	return "", fmt.Errorf("model didn't call the %s tool", commentsToolName)
+}
+
+// decodeComments decodes the arguments of a comments tool call.
+func decodeComments(arguments string) ([]Comment, error) {
+	var comments CommentJSON
+	if err := json.Unmarshal([]byte(arguments), &comments); err != nil {
+		return nil, fmt.Errorf("invalid %s tool arguments: %v", commentsToolName, err)
+	}
+	return comments.Comments, nil
+}
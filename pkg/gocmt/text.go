@@ -0,0 +1,43 @@
+package gocmt
+
+import "strings"
+
+// utf8BOM is the byte order mark some editors, notably on Windows, write at
+// the start of UTF-8 files.
+const utf8BOM = "\uFEFF"
+
+// textFormat records the byte order mark and line endings of a source file,
+// so that the code with the comments added can be written back the same way.
+type textFormat struct {
+	bom  bool
+	crlf bool
+}
+
+// normalizeText strips a leading byte order mark from src and converts CRLF
+// line endings to LF, which the byte offsets of the parser and the printer
+// assume. Files mixing both line endings are left as they are, since they
+// couldn't be restored faithfully.
+func normalizeText(src string) (string, textFormat) {
+	var f textFormat
+	if strings.HasPrefix(src, utf8BOM) {
+		f.bom = true
+		src = src[len(utf8BOM):]
+	}
+	if n := strings.Count(src, "\r\n"); n > 0 && n == strings.Count(src, "\n") {
+		f.crlf = true
+		src = strings.ReplaceAll(src, "\r\n", "\n")
+	}
+	return src, f
+}
+
+// restore converts code, normalized by normalizeText, back to the byte
+// order mark and line endings recorded in f.
+func (f textFormat) restore(code string) string {
+	if f.crlf {
+		code = strings.ReplaceAll(code, "\n", "\r\n")
+	}
+	if f.bom {
+		code = utf8BOM + code
+	}
+	return code
+}
@@ -0,0 +1,72 @@
+package gocmt
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+		f    textFormat
+	}{
+		{"LF", "package p\n", "package p\n", textFormat{}},
+		{"CRLF", "package p\r\n\r\nvar x = 1\r\n", "package p\n\nvar x = 1\n", textFormat{crlf: true}},
+		{"BOM", "\uFEFFpackage p\n", "package p\n", textFormat{bom: true}},
+		{"BOM and CRLF", "\uFEFFpackage p\r\n", "package p\n", textFormat{bom: true, crlf: true}},
+		{"mixed line endings", "package p\r\n\nvar x = 1\n", "package p\r\n\nvar x = 1\n", textFormat{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, f := normalizeText(tt.src)
+			if got != tt.want || f != tt.f {
+				t.Errorf("normalizeText() = %q, %+v, want %q, %+v", got, f, tt.want, tt.f)
+			}
+			if restored := f.restore(got); restored != tt.src {
+				t.Errorf("restore() = %q, want %q", restored, tt.src)
+			}
+		})
+	}
+}
+
+func TestGenerateTextFormat(t *testing.T) {
+	response := commentsResponse("func F() {", "F does nothing.", "type T struct {", "T is empty.")
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "CRLF",
+			src:  "package p\r\n\r\nfunc F() {}\r\n\r\ntype T struct {\r\n}\r\n",
+			want: "package p\r\n\r\n// F does nothing.\r\nfunc F() {}\r\n\r\n// T is empty.\r\ntype T struct {\r\n}\r\n",
+		},
+		{
+			name: "BOM",
+			src:  "\uFEFFpackage p\n\nfunc F() {}\n\ntype T struct {\n}\n",
+			want: "\uFEFFpackage p\n\n// F does nothing.\nfunc F() {}\n\n// T is empty.\ntype T struct {\n}\n",
+		},
+		{
+			name: "BOM and CRLF",
+			src:  "\uFEFFpackage p\r\n\r\nfunc F() {}\r\n\r\ntype T struct {\r\n}\r\n",
+			want: "\uFEFFpackage p\r\n\r\n// F does nothing.\r\nfunc F() {}\r\n\r\n// T is empty.\r\ntype T struct {\r\n}\r\n",
+		},
+	}
+	for _, tt := range tests {
+		for _, noReformat := range []bool{false, true} {
+			g, err := NewCommentGenerator(Options{Client: &fakeClient{content: response}, NoReformat: noReformat})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := g.Generate(context.Background(), tt.src)
+			if err != nil {
+				t.Fatalf("%s: Generate() error = %v", tt.name, err)
+			}
+			if result.Code != tt.want {
+				t.Errorf("%s: Generate(NoReformat: %v) = %q, want %q", tt.name, noReformat, result.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The formats of the progress reported as files finish, selected by
+// -progress.
+const (
+	progressText = "text"
+	progressJSON = "json"
+)
+
+// The statuses of a finished file in JSON progress.
+const (
+	statusDone      = "done"
+	statusSkipped   = "skipped"
+	statusFailed    = "failed"
+	statusCancelled = "cancelled"
+)
+
+// progressEvent is reported when a file finishes. In JSON mode each event is
+// written as a line of JSON so that editors and other tools can follow the
+// run.
+type progressEvent struct {
+	File      string `json:"file"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+}
+
+// validateProgress checks the value of -progress.
+func validateProgress(format string) error {
+	switch format {
+	case progressText, progressJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid progress format %q, must be one of: text, json", format)
+}
+
+// writeProgressJSON writes ev to w as a single line of JSON.
+func writeProgressJSON(w io.Writer, ev progressEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// progressBarWidth is the number of cells of the progress bar.
+const progressBarWidth = 20
+
+// progressLine describes the text progress after completed of total files
+// finished in elapsed time: the count, the percentage, the throughput and an
+// estimate of the time left based on the time taken per file so far. With
+// bar set it starts with a progress bar, for a status line updated in place.
+func progressLine(completed, total int, elapsed time.Duration, bar bool) string {
+	var b strings.Builder
+	b.WriteString("Progress: ")
+	if bar {
+		filled := completed * progressBarWidth / total
+		fmt.Fprintf(&b, "[%s%s] ", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled))
+	}
+	fmt.Fprintf(&b, "%d/%d, %.2f%%", completed, total, float64(completed)/float64(total)*100)
+	if completed == 0 || elapsed <= 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, ", %.1f files/min", float64(completed)/elapsed.Minutes())
+	if completed < total {
+		perFile := elapsed / time.Duration(completed)
+		fmt.Fprintf(&b, ", ETA %s", (perFile * time.Duration(total-completed)).Round(time.Second))
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// stats collects a report of the run for -stats, for dashboards tracking
+// the documentation coverage and the cost over time.
+type stats struct {
+	path string
+
+	mu    sync.Mutex
+	files []fileStats
+}
+
+// fileStats is the report of a processed file.
+type fileStats struct {
+	File   string `json:"file"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Comments is the number of comments added, or that would be added
+	// with -dry-run or -patch.
+	Comments         int    `json:"comments"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	LatencyMS        int64  `json:"latency_ms"`
+	Model            string `json:"model,omitempty"`
+}
+
+// statsTotals sums up the run.
+type statsTotals struct {
+	Files            int     `json:"files"`
+	Commented        int     `json:"commented"`
+	Failed           int     `json:"failed"`
+	Skipped          int     `json:"skipped"`
+	Comments         int     `json:"comments"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	DurationMS       int64   `json:"duration_ms"`
+	Cost             float64 `json:"estimated_cost_usd,omitempty"`
+}
+
+// statsFile is the on-disk format of the report.
+type statsFile struct {
+	Files  []fileStats `json:"files"`
+	Totals statsTotals `json:"totals"`
+}
+
+// newStats returns a report written to path when saved.
+func newStats(path string) *stats {
+	return &stats{path: path}
+}
+
+// record adds the report of a file. It is safe to call from concurrent
+// workers.
+func (s *stats) record(f fileStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, f)
+}
+
+// save writes the report with the files sorted by path, and totals
+// completed with the sums over the files.
+func (s *stats) save(totals statsTotals) error {
+	s.mu.Lock()
+	files := append([]fileStats{}, s.files...)
+	s.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].File < files[j].File })
+	totals.Files = len(files)
+	for _, f := range files {
+		totals.Comments += f.Comments
+	}
+	data, err := json.MarshalIndent(statsFile{Files: files, Totals: totals}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(data, '\n'), 0644)
+}
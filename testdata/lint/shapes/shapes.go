@@ -0,0 +1,25 @@
+package shapes
+
+import "math"
+
+type Shape interface {
+	Area() float64
+}
+
+type Circle struct {
+	Radius float64
+}
+
+func (c Circle) Area() float64 {
+	return math.Pi * c.Radius * c.Radius
+}
+
+type Rect struct{ W, H float64 }
+
+func (r *Rect) Area() float64 { return r.W * r.H }
+
+func NewRect(w, h float64) *Rect {
+	return &Rect{W: w, H: h}
+}
+
+func scale(s float64) float64 { return s * Unit }
@@ -0,0 +1,10 @@
+package shapes
+
+const (
+	Unit = 1.0
+	Zero = 0.0
+)
+
+var DefaultCircle = Circle{Radius: Unit}
+
+const Max = 100
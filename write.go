@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeFileAtomic writes data to path without ever leaving a partially
+// written file behind: the data goes to a temporary file in the same
+// directory, which is synced and then renamed over path with permission
+// bits perm. A symlink at path is followed, so that its target is updated
+// rather than the link replaced by a regular file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".gocmt-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		// Clean up if anything failed before the rename.
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, path)
+	return err
+}
+
+// mapOutputPaths returns the path under outputDir that each of files is
+// written to for -output-dir. A file keeps its path relative to the
+// outermost of roots, the -f paths, that contains it; a file given as a root
+// itself is written under its base name. Files not under any root, such as
+// those selected with -c, keep their path relative to the current
+// directory. It fails if a file lies outside the current directory in that
+// case, or if two files would be written to the same path.
+func mapOutputPaths(outputDir string, roots, files []string) (map[string]string, error) {
+	paths := make(map[string]string, len(files))
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		rel := ""
+		for _, root := range roots {
+			if filepath.Clean(root) == filepath.Clean(file) {
+				if rel == "" {
+					rel = filepath.Base(file)
+				}
+				continue
+			}
+			r, err := filepath.Rel(root, file)
+			if err != nil || !localPath(r) {
+				continue
+			}
+			if rel == "" || len(r) > len(rel) {
+				rel = r
+			}
+		}
+		if rel == "" {
+			r, err := filepath.Rel(".", file)
+			if err != nil || !localPath(r) {
+				return nil, fmt.Errorf("cannot place %s under -output-dir, it is outside the current directory", file)
+			}
+			rel = r
+		}
+
+		out := filepath.Join(outputDir, rel)
+		if other, ok := sources[out]; ok {
+			return nil, fmt.Errorf("both %s and %s would be written to %s", other, file, out)
+		}
+		sources[out] = file
+		paths[file] = out
+	}
+	return paths, nil
+}
+
+// localPath reports whether the relative path rel stays within the
+// directory it is relative to.
+func localPath(rel string) bool {
+	return !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeOutput writes data to path for -output-dir, creating the parent
+// directories as needed.
+func writeOutput(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, perm)
+}